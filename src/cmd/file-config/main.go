@@ -5,18 +5,38 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"path/filepath"
 
 	"gopkg.in/yaml.v3"
 )
 
 func main() {
 	configPath := flag.String("config", "", "Path to YAML config file")
+	listIncludes := flag.Bool("includes", false, "List the files included by the config or locations file")
+	includesRoot := flag.String("root", "", "Print included files relative to this directory, includes resolving outside of it are rejected")
 	flag.Parse()
 
 	if *configPath == "" {
 		log.Fatal("Please provide a config file path using -config flag")
 	}
 
+	if *listIncludes {
+		includes, err := file_config.ListIncludes(*configPath, *includesRoot)
+		if err != nil {
+			log.Fatalf("Error listing includes: %v", err)
+		}
+		for _, include := range includes {
+			if *includesRoot != "" {
+				include, err = filepath.Rel(*includesRoot, include)
+				if err != nil {
+					log.Fatalf("Error resolving include path: %v", err)
+				}
+			}
+			fmt.Println(include)
+		}
+		return
+	}
+
 	// Get query from positional argument
 	args := flag.Args()
 	var query string
@@ -1,24 +1,41 @@
 package main
 
 import (
-	"dokku-nginx-custom/src/pkg/file_config"
+	"context"
+	"dokku-nginx-custom/src/pkg/builder"
 	"flag"
-	"fmt"
 	"log"
 	"os"
-	"os/exec"
-	"path"
 	"path/filepath"
-	"regexp"
-	"strconv"
 	"strings"
 	"time"
-
-	"dario.cat/mergo"
-	"github.com/gliderlabs/sigil"
-	_ "github.com/gliderlabs/sigil/builtin"
 )
 
+// version is the builder version, set at build time with
+// -ldflags "-X main.version=<version>"
+var version = "dev"
+
+// manifestEnvKeys are the build inputs passed through the environment that
+// end up in the rendered config
+var manifestEnvKeys = []string{
+	"DOKKU_APP_LISTENERS",
+	"DOKKU_APP_LISTENERS_JSON",
+	"DOKKU_UPSTREAM_APP_LISTENERS",
+	"DOKKU_PROCESS_LISTENERS",
+	"PROXY_PORT",
+	"PROXY_PORT_MAP",
+	"PROXY_UPSTREAM_PORTS",
+	"APP_SSL_PATH",
+	"PROXY_CACHE_ON_DISK_ROOT_PATH",
+	"PROXY_CACHE_IN_MEM_ROOT_PATH",
+	"FASTCGI_CACHE_ON_DISK_ROOT_PATH",
+	"FASTCGI_CACHE_IN_MEM_ROOT_PATH",
+	"PROXY_CACHE_DEFAULT_FLAGS",
+	"FASTCGI_CACHE_DEFAULT_FLAGS",
+	"PROXY_CACHE_DEFAULT_KEY_ZONE_SIZE",
+	"FASTCGI_CACHE_DEFAULT_KEY_ZONE_SIZE",
+}
+
 func mustEnv(name string) string {
 	value := os.Getenv(name)
 	if value == "" {
@@ -27,754 +44,237 @@ func mustEnv(name string) string {
 	return value
 }
 
-type upstreamConfigTemplateData struct {
-	ProxyUpstreamPorts []string `json:"ProxyUpstreamPorts"`
-	AppListeners       []string `json:"AppListeners"`
-	App                string   `json:"App"`
-}
-
-type upstreamServer struct {
-	Addr        string            `json:"addr"`
-	Flags       map[string]string `json:"flags"`
-	FlagsString string            `json:"flagsString"`
-}
-
-type upstreamConfig struct {
-	GeneratedUpstreamName string           `json:"generatedUpstreamName"`
-	Servers               []upstreamServer `json:"servers"`
-}
-
-type upstreamResultingNames map[string]string
-
-func buildUpstreamConfig(appName string, config *file_config.Config, data *upstreamConfigTemplateData) (string, upstreamResultingNames, error) {
-	upstreamConfigs := make(map[string]*upstreamConfig, 0)
-
-	upstreamResultingNames := make(upstreamResultingNames, 0)
-
-	// default upstreams
-	for _, port := range data.ProxyUpstreamPorts {
-		refName := fmt.Sprintf("default-%s", port)
-		generatedUpstreamName := fmt.Sprintf("%s-%s", appName, port)
-		upstreamResultingNames[refName] = generatedUpstreamName
-
-		if _, ok := upstreamResultingNames["default"]; !ok {
-			upstreamResultingNames["default"] = generatedUpstreamName
-		}
-
-		upstreamMapKey := fmt.Sprintf("default-%s", port)
-		upstreamConfigs[upstreamMapKey] = &upstreamConfig{
-			GeneratedUpstreamName: generatedUpstreamName,
-			Servers:               make([]upstreamServer, 0),
-		}
-		uc := upstreamConfigs[upstreamMapKey]
-		for _, listener := range data.AppListeners {
-			listenerSplit := strings.Split(listener, ":")
-			if len(listenerSplit) != 2 {
-				return "", nil, fmt.Errorf("failed to parse listener %s", listener)
-			}
-			upstreamAddr := listenerSplit[0]
-			uc.Servers = append(uc.Servers, upstreamServer{
-				Addr: fmt.Sprintf("%s:%s", upstreamAddr, port),
-			})
-			upstreamConfigs[upstreamMapKey] = uc
+// readAppListeners returns the app's web listeners and its listeners by
+// process type. DOKKU_APP_LISTENERS_JSON carries container metadata for the
+// structured server selectors, the flat DOKKU_APP_LISTENERS and
+// DOKKU_PROCESS_LISTENERS are used when it is not set.
+func readAppListeners() ([]builder.Listener, map[string][]builder.Listener, error) {
+	if listenersJSON := os.Getenv("DOKKU_APP_LISTENERS_JSON"); listenersJSON != "" {
+		processListeners, err := builder.ParseListenersJSON(listenersJSON)
+		if err != nil {
+			return nil, nil, err
 		}
+		return processListeners["web"], processListeners, nil
 	}
 
-	// user-supplied upstreams
-	for _, upstream := range config.Upstreams {
-		if upstream.Name == "" {
-			continue
-		}
-		generatedUpstreamName := fmt.Sprintf("%s-%s", appName, upstream.Name)
-		upstreamConfigs[upstream.Name] = &upstreamConfig{
-			GeneratedUpstreamName: generatedUpstreamName,
-		}
-		upstreamResultingNames[upstream.Name] = generatedUpstreamName
-		uc := upstreamConfigs[upstream.Name]
-		uc.Servers = make([]upstreamServer, 0)
-		for _, server := range upstream.Servers {
-			uc.Servers = append(uc.Servers, upstreamServer{
-				Addr:  server.Addr,
-				Flags: server.Flags,
-			})
-		}
+	// empty when the app has no running containers
+	appListeners, err := builder.NewListeners("web", strings.Fields(os.Getenv("DOKKU_APP_LISTENERS")))
+	if err != nil {
+		return nil, nil, err
 	}
 
-	for _, upstreamCfg := range config.Upstreams {
-		var ucs []*upstreamConfig
-		if !upstreamCfg.SelectDefault {
-			continue
-		}
-
-		if upstreamCfg.SelectDefaultPort != 0 {
-			uc, ok := upstreamConfigs[fmt.Sprintf("default-%d", upstreamCfg.SelectDefaultPort)]
-			if !ok {
-				return "", nil, fmt.Errorf("failed to find upstream config for port %d", upstreamCfg.SelectDefaultPort)
-			}
-			ucs = append(ucs, uc)
-		} else {
-			for _, uc := range upstreamConfigs {
-				ucs = append(ucs, uc)
-			}
-		}
-
-		if upstreamCfg.DefaultServersFlags != nil {
-			for _, serverFlagCfg := range upstreamCfg.DefaultServersFlags {
-				for _, uc := range ucs {
-					if serverFlagCfg.Selector == "" {
-						for i := range uc.Servers {
-							// empty selector field means all servers apply
-							mergo.Merge(&uc.Servers[i].Flags, serverFlagCfg.Flags, mergo.WithOverride)
-						}
-					} else {
-						for i, server := range uc.Servers {
-							regex, err := regexp.Compile(serverFlagCfg.Selector)
-							if err != nil {
-								return "", nil, fmt.Errorf("failed to compile regex: %v", err)
-							}
-							if regex.MatchString(server.Addr) {
-								mergo.Merge(&uc.Servers[i].Flags, serverFlagCfg.Flags, mergo.WithOverride)
-							}
-						}
-					}
-				}
-			}
-		}
+	processListeners := make(map[string][]builder.Listener)
+	namedListeners, err := builder.ParseNamedListeners(os.Getenv("DOKKU_PROCESS_LISTENERS"))
+	if err != nil {
+		return nil, nil, err
 	}
-
-	for _, uc := range upstreamConfigs {
-		for i, server := range uc.Servers {
-			for k, v := range server.Flags {
-				flagString := k
-				if v != "" {
-					flagString = fmt.Sprintf("%s=%s", k, v)
-				}
-				if uc.Servers[i].FlagsString != "" {
-					uc.Servers[i].FlagsString += " "
-				}
-				flagStringTemplated, err := sigil.Execute([]byte(flagString), map[string]any{"vars": config.UserVars}, "flag_string")
-				if err != nil {
-					return "", nil, fmt.Errorf("failed to parse template: %w", err)
-				}
-				uc.Servers[i].FlagsString += flagStringTemplated.String()
-			}
+	for processType, listeners := range namedListeners {
+		if processListeners[processType], err = builder.NewListeners(processType, listeners); err != nil {
+			return nil, nil, err
 		}
 	}
 
-	templateStr := `{{- range $key, $value := $.upstreamConfigs -}}
-upstream {{ $value.GeneratedUpstreamName }} {
-{{- range $server := $value.Servers }}
-  server {{ $server.Addr }} {{- if $server.FlagsString }} {{ $server.FlagsString }}{{ end -}};
-{{- end }}
+	return appListeners, processListeners, nil
 }
-{{ end -}}`
-
-	dataRaw := map[string]any{
-		"upstreamConfigs": upstreamConfigs,
-		"vars":            config.UserVars,
-	}
 
-	fmt.Println(upstreamConfigs)
-
-	result, err := sigil.Execute([]byte(templateStr), dataRaw, "upstream_config")
+// readUpstreamAppListeners returns the web listeners of the apps referenced
+// by `app:` upstreams, from DOKKU_UPSTREAM_APP_LISTENERS.
+func readUpstreamAppListeners() (map[string][]builder.Listener, error) {
+	upstreamAppListeners := make(map[string][]builder.Listener)
+	namedListeners, err := builder.ParseNamedListeners(os.Getenv("DOKKU_UPSTREAM_APP_LISTENERS"))
 	if err != nil {
-		log.Fatalln("failed to parse template:", err)
-	}
-
-	return result.String(), upstreamResultingNames, nil
-}
-
-type mapConfig struct {
-	String   string `json:"string" yaml:"string"`
-	Variable string `json:"variable" yaml:"variable"`
-	Lines    string `json:"lines" yaml:"lines"`
-}
-
-type mapResultingVariables map[string]string
-
-func buildMapConfig(appName string, config *file_config.Config) (string, mapResultingVariables, error) {
-	mapConfigStr := ""
-
-	templateStr := `map {{ $.string }} ${{ $.variable }} {
-{{- range $line := $.lines }}
-  {{ $line }}
-{{- end }}
-}
-`
-
-	mapResultingVariables := make(mapResultingVariables, 0)
-
-	for _, mapVar := range config.Maps {
-		variableName := fmt.Sprintf("%s_%s", appName, mapVar.Variable)
-
-		linesOut, err := sigil.Execute([]byte(mapVar.Lines), map[string]any{"vars": config.UserVars}, "map_lines")
-		if err != nil {
-			return "", nil, fmt.Errorf("failed to parse template: %w", err)
-		}
-
-		stringOut, err := sigil.Execute([]byte(mapVar.String), map[string]any{"vars": config.UserVars}, "map_string")
-		if err != nil {
-			return "", nil, fmt.Errorf("failed to parse template: %w", err)
-		}
-
-		dataRaw := map[string]any{
-			"variable": variableName,
-			"string":   stringOut.String(),
-			"lines":    strings.Split(linesOut.String(), "\n"),
-		}
-
-		result, err := sigil.Execute([]byte(templateStr), dataRaw, "map_config")
-		if err != nil {
-			return "", nil, fmt.Errorf("failed to parse template: %w", err)
-		}
-		mapConfigStr += result.String()
-
-		for _, mapVar := range config.Maps {
-			mapResultingVariables[mapVar.Variable] = variableName
-		}
-
+		return nil, err
 	}
-
-	return mapConfigStr, mapResultingVariables, nil
-}
-
-type buildProxyCacheConfigData struct {
-	proxyCacheOnDiskRootPath string
-	proxyCacheInMemRootPath  string
-	proxyCacheDefaultFlags   map[string]string
-	proxyCacheKeyZoneSize    string
-
-	fastcgiOnDiskRootPath string
-	fastcgiInMemRootPath  string
-	fastcgiDefaultFlags   map[string]string
-	fastcgiKeyZoneSize    string
-}
-
-type cacheResultingNames map[string]string
-
-func buildProxyCacheConfig(appName string, buildProxyCacheCfgData buildProxyCacheConfigData, config *file_config.Config) (string, cacheResultingNames, error) {
-	cacheResultingNames := make(cacheResultingNames, 0)
-
-	cfgStr := ""
-
-	for _, cache := range config.ProxyCaches {
-		cacheName := fmt.Sprintf("%s_%s", appName, cache.Name)
-		cachePath := cache.CachePath
-		if cachePath == "" {
-			if cache.InMem {
-				cachePath = path.Join(buildProxyCacheCfgData.proxyCacheInMemRootPath, cacheName)
-			} else {
-				cachePath = path.Join(buildProxyCacheCfgData.proxyCacheOnDiskRootPath, cacheName)
-			}
-		}
-
-		flags := buildProxyCacheCfgData.proxyCacheDefaultFlags
-		if cache.Flags != nil {
-			mergo.Merge(&flags, cache.Flags, mergo.WithOverride)
+	for upstreamApp, listeners := range namedListeners {
+		if upstreamAppListeners[upstreamApp], err = builder.NewListeners("web", listeners); err != nil {
+			return nil, err
 		}
-
-		keyZoneSize := cache.KeyZoneSize
-		if keyZoneSize == "" {
-			keyZoneSize = buildProxyCacheCfgData.proxyCacheKeyZoneSize
-		}
-
-		cacheResultingNames[cache.Name] = cacheName
-
-		flagStr := ""
-		for k, v := range flags {
-			str := k
-			if v != "" {
-				str = fmt.Sprintf("%s=%s", k, v)
-			}
-			if flagStr != "" {
-				flagStr = flagStr + " "
-			}
-			tmplOut, err := sigil.Execute([]byte(str), map[string]any{"vars": config.UserVars}, "proxy_cache_flag_string")
-			if err != nil {
-				return "", nil, fmt.Errorf("failed to parse template: %w", err)
-			}
-			flagStr += tmplOut.String()
-		}
-
-		if cfgStr != "" {
-			cfgStr += "\n"
-		}
-
-		cfgStr += fmt.Sprintf("proxy_cache_path %s keys_zone=%s:%s %s;", cachePath, cacheName, keyZoneSize, flagStr)
 	}
-
-	return cfgStr, cacheResultingNames, nil
+	return upstreamAppListeners, nil
 }
 
-func buildFastcgiCacheConfig(appName string, buildProxyCacheCfgData buildProxyCacheConfigData, config *file_config.Config) (string, cacheResultingNames, error) {
-	cacheResultingNames := make(cacheResultingNames, 0)
-
-	cfgStr := ""
-
-	for _, cache := range config.FastcgiCaches {
-		cacheName := fmt.Sprintf("%s_%s", appName, cache.Name)
-		cachePath := cache.CachePath
-		if cachePath == "" {
-			if cache.InMem {
-				cachePath = path.Join(buildProxyCacheCfgData.fastcgiInMemRootPath, cacheName)
-			} else {
-				cachePath = path.Join(buildProxyCacheCfgData.fastcgiOnDiskRootPath, cacheName)
-			}
-		}
-
-		flags := buildProxyCacheCfgData.fastcgiDefaultFlags
-		if cache.Flags != nil {
-			mergo.Merge(&flags, cache.Flags, mergo.WithOverride)
-		}
-
-		keyZoneSize := cache.KeyZoneSize
-		if keyZoneSize == "" {
-			keyZoneSize = buildProxyCacheCfgData.fastcgiKeyZoneSize
-		}
-
-		cacheResultingNames[cache.Name] = cacheName
-
-		flagStr := ""
-		for k, v := range flags {
-			str := k
-			if v != "" {
-				str = fmt.Sprintf("%s=%s", k, v)
-			}
-			if flagStr != "" {
-				flagStr = flagStr + " "
-			}
-			tmplOut, err := sigil.Execute([]byte(str), map[string]any{"vars": config.UserVars}, "fastcgi_cache_flag_string")
-			if err != nil {
-				return "", nil, fmt.Errorf("failed to parse template: %w", err)
-			}
-			flagStr += tmplOut.String()
-		}
-
-		if cfgStr != "" {
-			cfgStr += "\n"
+// parseCacheFlags parses space-separated flag or flag=value entries.
+func parseCacheFlags(value string) map[string]string {
+	flags := make(map[string]string)
+	for _, flag := range strings.Split(value, " ") {
+		flagSplit := strings.Split(flag, "=")
+		if len(flagSplit) != 2 {
+			flags[flagSplit[0]] = ""
+		} else {
+			flags[flagSplit[0]] = flagSplit[1]
 		}
-		cfgStr += fmt.Sprintf("fastcgi_cache_path %s keys_zone=%s:%s %s;", cachePath, cacheName, keyZoneSize, flagStr)
 	}
-
-	return cfgStr, cacheResultingNames, nil
-}
-
-type locationConfigData struct {
-	upstreams     upstreamResultingNames
-	mapVariables  mapResultingVariables
-	proxyCaches   cacheResultingNames
-	fastcgiCaches cacheResultingNames
+	return flags
 }
 
-type vhostToLocationConfigStringMap map[string]string
-
-func buildLocationConfig(appName string, config *file_config.Config, data *locationConfigData) (vhostToLocationConfigStringMap, error) {
-	locationConfigs := make(vhostToLocationConfigStringMap, 0)
-
-	tmplLocationBlockStr := `location {{ $.modifier }} {{ if $.named }}@{{ $.named }}{{ else }}{{ $.uri }}{{ end }} {
-{{- range $line := $.bodyLines }}
-  {{ $line -}}
-{{- end }}
-}
-`
-
-	for _, vhost := range config.Vhosts {
-		locationConfigStr := ""
-
-		variableNames := make(map[string]string)
-		variables := make(map[string]string)
-
-		for _, variable := range vhost.Variables {
-			variableNames[variable.Name] = variable.Name
-			variables[variable.Name] = variable.Value
-		}
-
-		tmplData := map[string]any{
-			"locationConfigs": make(map[string]any),
-			"vars":            config.UserVars,
-		}
-
-		namedLocations := make(map[string]string)
-		for _, location := range vhost.Locations {
-			if location.Named != "" {
-				namedLocations[location.Named] = fmt.Sprintf("%s_%s", appName, location.Named)
-			}
-		}
+func main() {
+	var opts builder.Options
+	flag.StringVar(&opts.AppName, "app-name", "", "app name")
+	flag.StringVar(&opts.ConfigFilePath, "config-file-path", "", "path to config file")
+	flag.StringVar(&opts.DataRootDirectory, "dokku-data-root-directory", "", "dokku data root directory")
+	flag.StringVar(&opts.NginxTestCommand, "nginx-test-command", "nginx -t", "nginx test command")
+	flag.BoolVar(&opts.WithoutNginxTest, "without-nginx-test", false, "do not run nginx test")
+	flag.StringVar(&opts.ErrorPagesDirectory, "error-pages-directory", "", "directory holding the error pages served by owned vhosts")
+
+	var prune bool
+	flag.StringVar(&opts.NginxReloadCommand, "nginx-reload-command", "nginx -s reload", "nginx reload command")
+	flag.BoolVar(&opts.WithoutNginxReload, "without-nginx-reload", false, "do not reload nginx")
+	flag.StringVar(&opts.NginxPidFile, "nginx-pid-file", "", "nginx master pid file, used to check a new worker generation started after a reload")
+	flag.DurationVar(&opts.NginxReloadTimeout, "nginx-reload-timeout", 10*time.Second, "how long to wait for new workers after a reload")
+
+	flag.StringVar(&opts.ProbeAddress, "probe-address", "127.0.0.1", "address of the nginx listener the config probes are sent to")
+	flag.BoolVar(&opts.WithoutProbes, "without-probes", false, "do not run the config probes after a reload")
+
+	flag.BoolVar(&opts.Force, "force", false, "build and deploy a release even when the config matches the current release")
+
+	flag.BoolVar(&prune, "prune", false, "only prune the releases falling out of retention")
+	flag.IntVar(&opts.ReleaseRetentionCount, "release-retention-count", 10, "number of latest releases to keep")
+	flag.Func("release-retention-age", "keep releases younger than this duration, such as 72h or 7d", func(value string) error {
+		var err error
+		opts.ReleaseRetentionAge, err = builder.ParseRetentionAge(value)
+		return err
+	})
 
-		bodyTmplData := map[string]any{
-			"map_variables":   data.mapVariables,
-			"upstreams":       data.upstreams,
-			"proxy_caches":    data.proxyCaches,
-			"fastcgi_caches":  data.fastcgiCaches,
-			"variables":       variableNames,
-			"named_locations": namedLocations,
-			"vars":            config.UserVars,
-		}
+	flag.DurationVar(&opts.LockTimeout, "lock-timeout", 5*time.Minute, "how long to wait for the build and global nginx locks")
+	flag.StringVar(&opts.GlobalLockPath, "global-lock-path", "", "lock file shared by the builds of all apps, defaults to nginx.lock next to the app data root directory")
 
-		for _, location := range vhost.Locations {
-			if location.Include != "" {
-				continue
-			}
-
-			modifierOut, err := sigil.Execute([]byte(location.Modifier), bodyTmplData, fmt.Sprintf("location_modifier_vhost_%s_uri_%s", vhost.ServerName, location.Uri))
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse template: %w", err)
-			}
-			tmplData["modifier"] = modifierOut.String()
-
-			uriOut, err := sigil.Execute([]byte(location.Uri), bodyTmplData, fmt.Sprintf("location_uri_vhost_%s_uri_%s", vhost.ServerName, location.Uri))
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse template: %w", err)
-			}
-			tmplData["uri"] = uriOut.String()
-
-			bodyOut, err := sigil.Execute([]byte(location.Body), bodyTmplData, fmt.Sprintf("location_body_vhost_%s_uri_%s", vhost.ServerName, location.Uri))
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse template: %w", err)
-			}
-			bodyLines := strings.Split(bodyOut.String(), "\n")
-			tmplData["bodyLines"] = bodyLines
-
-			if location.Named != "" {
-				tmplData["named"] = namedLocations[location.Named]
-			} else {
-				tmplData["named"] = ""
-			}
-
-			locationOut, err := sigil.Execute([]byte(tmplLocationBlockStr), tmplData, fmt.Sprintf("location_block_vhost_%s_uri_%s", vhost.ServerName, location.Uri))
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse template: %w", err)
-			}
-
-			if locationConfigStr != "" {
-				locationConfigStr += "\n"
-			}
-			locationConfigStr += locationOut.String()
+	flag.IntVar(&opts.BackupRetentionCount, "backup-retention-count", 5, "number of latest snapshots taken before builds to keep")
 
-		}
+	var contextFilePath string
+	var outputDir string
+	flag.StringVar(&contextFilePath, "context-file", "", "render offline with the build inputs of this YAML or JSON file instead of the env vars, into -output-dir")
+	flag.StringVar(&outputDir, "output-dir", "", "directory the offline render is written to")
 
-		locationConfigs[vhost.ServerName] = locationConfigStr
-	}
+	var plan bool
+	var detailedExitcode bool
+	flag.BoolVar(&plan, "plan", false, "print the changes a build would make to the current release, without building")
+	flag.BoolVar(&detailedExitcode, "detailed-exitcode", false, "with -plan, exit with 2 when a build would change the config")
 
-	return locationConfigs, nil
-}
-
-var nginxWorkingDirectory string
+	flag.Parse()
 
-func getCurrentConfigVersionDirectory(nginxConfigDirectory string) (string, error) {
-	files, err := filepath.Glob(path.Join(nginxConfigDirectory, "release-*"))
-	if err != nil {
-		return "", fmt.Errorf("failed to read nginx config directory: %w", err)
+	required := []string{"app-name", "config-file-path"}
+	// releases list|rollback|diff and backups list|export|import only act on
+	// existing releases and snapshots
+	releasesMode := flag.Arg(0) == "releases"
+	backupsMode := flag.Arg(0) == "backups"
+	if prune || releasesMode || backupsMode {
+		required = []string{"dokku-data-root-directory"}
 	}
-
-	if len(files) == 0 {
-		yyyymmdd := time.Now().Format("20060102")
-		return fmt.Sprintf("%s/release-%s.1", nginxConfigDirectory, yyyymmdd), nil
+	// the app name comes from the context file
+	if contextFilePath != "" {
+		required = []string{"config-file-path", "output-dir"}
 	}
 
-	var latestDir string
-	var latestDate int
-	var latestSequence int
-
-	releasePattern := regexp.MustCompile(`^release-(\d+)\.(\d+)$`)
-
-	for _, file := range files {
-		dirName := filepath.Base(file)
-
-		if info, err := os.Stat(file); err != nil || !info.IsDir() {
-			continue
+	seen := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { seen[f.Name] = true })
+	for _, req := range required {
+		if !seen[req] {
+			log.Fatalf("missing required -%s argument/flag", req)
 		}
+	}
 
-		matches := releasePattern.FindStringSubmatch(dirName)
-		if len(matches) != 3 {
-			continue
-		}
+	ctx := context.Background()
 
-		date, err := strconv.Atoi(matches[1])
+	if contextFilePath != "" {
+		renderCtx, err := builder.ReadRenderContext(contextFilePath)
 		if err != nil {
-			continue
+			log.Fatalln(err)
 		}
-		sequence, err := strconv.Atoi(matches[2])
+		renderOpts, err := renderCtx.Options(opts.ConfigFilePath)
 		if err != nil {
-			continue
+			log.Fatalln("failed to read context file:", err)
 		}
 
-		if latestDir == "" || date > latestDate || (date == latestDate && sequence > latestSequence) {
-			latestDir = file
-			latestDate = date
-			latestSequence = sequence
+		result, err := builder.Render(ctx, renderOpts, outputDir)
+		if err != nil {
+			log.Fatalln(err)
 		}
-	}
-
-	if latestDir == "" {
-		return "", fmt.Errorf("no valid release directories found")
-	}
-
-	return latestDir, nil
-}
-
-func getPreviousVersionDirectory(nginxConfigDirectory string) (string, error) {
-	currentSymlink := path.Join(nginxConfigDirectory, "current")
-
-	// Check if current symlink exists
-	if _, err := os.Lstat(currentSymlink); os.IsNotExist(err) {
-		return "", nil // No previous version
-	}
-
-	// Resolve the symlink
-	previousDir, err := os.Readlink(currentSymlink)
-	if err != nil {
-		return "", fmt.Errorf("failed to read current symlink: %w", err)
-	}
-
-	// Make it absolute if it's relative
-	if !path.IsAbs(previousDir) {
-		previousDir = path.Join(nginxConfigDirectory, previousDir)
-	}
-
-	return previousDir, nil
-}
-
-func copyConfigToRelease(configContent string, releaseDir string, filename string) error {
-	configPath := path.Join(releaseDir, filename)
-
-	// Create the full directory path including any subdirectories
-	configDir := path.Dir(configPath)
-	if err := os.MkdirAll(configDir, 0755); err != nil {
-		return fmt.Errorf("failed to create config directory %s: %w", configDir, err)
-	}
-
-	// Write the config content to the file
-	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
-		return fmt.Errorf("failed to write config file %s: %w", filename, err)
-	}
-
-	return nil
-}
-
-func updateCurrentSymlink(nginxConfigDirectory string, newReleaseDir string) error {
-	currentSymlink := path.Join(nginxConfigDirectory, "current")
-
-	// Remove existing symlink if it exists
-	if _, err := os.Lstat(currentSymlink); err == nil {
-		if err := os.Remove(currentSymlink); err != nil {
-			return fmt.Errorf("failed to remove existing current symlink: %w", err)
+		for _, warning := range result.Warnings {
+			log.Println(warning)
 		}
-	}
-
-	// Create new symlink
-	// Use relative path for the symlink
-	relPath, err := filepath.Rel(nginxConfigDirectory, newReleaseDir)
-	if err != nil {
-		return fmt.Errorf("failed to get relative path: %w", err)
-	}
-
-	if err := os.Symlink(relPath, currentSymlink); err != nil {
-		return fmt.Errorf("failed to create current symlink: %w", err)
-	}
-
-	return nil
-}
-
-func testNginxConfig(nginxTestCommand string) error {
-	cmd := exec.Command("sh", "-c", nginxTestCommand)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("nginx config test failed: %s", string(output))
-	}
-	return nil
-}
-
-func rollbackToPrevious(nginxConfigDirectory string, previousDir string) error {
-	if previousDir == "" {
-		// No previous version to rollback to, just remove current symlink
-		currentSymlink := path.Join(nginxConfigDirectory, "current")
-		if _, err := os.Lstat(currentSymlink); err == nil {
-			if err := os.Remove(currentSymlink); err != nil {
-				return fmt.Errorf("failed to remove current symlink during rollback: %w", err)
-			}
+		for _, file := range result.Files {
+			log.Println("rendered", filepath.Join(outputDir, file))
 		}
-		return nil
+		return
 	}
 
-	// Rollback to previous version
-	return updateCurrentSymlink(nginxConfigDirectory, previousDir)
-}
-
-func main() {
-
-	var appName string
-	var configFilePath string
-	var dokkuAppDataRootDirectory string
-	var nginxTestCommand string
-	var withoutNginxTest bool
-	flag.StringVar(&appName, "app-name", "", "app name")
-	flag.StringVar(&configFilePath, "config-file-path", "", "path to config file")
-	flag.StringVar(&dokkuAppDataRootDirectory, "dokku-data-root-directory", "", "dokku data root directory")
-	flag.StringVar(&nginxTestCommand, "nginx-test-command", "nginx -t", "nginx test command")
-	flag.BoolVar(&withoutNginxTest, "without-nginx-test", false, "do not run nginx test")
-
-	flag.Parse()
-
-	required := []string{"app-name", "config-file-path"}
+	opts.ProxyName = mustEnv("PROXY_NAME")
+	opts.BuilderVersion = version
 
-	seen := make(map[string]bool)
-	flag.Visit(func(f *flag.Flag) { seen[f.Name] = true })
-	for _, req := range required {
-		if !seen[req] {
-			log.Fatalf("missing required -%s argument/flag", req)
+	switch {
+	case releasesMode:
+		if err := builder.Releases(ctx, opts, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalln(err)
 		}
-	}
-
-	nginxWorkingDirectory = path.Join(dokkuAppDataRootDirectory, fmt.Sprintf("%s-config", mustEnv("PROXY_NAME")))
-	nginxBackupConfigs := path.Join(nginxWorkingDirectory, "backups")
-	_ = nginxBackupConfigs
-	nginxConfigDirectory := path.Join(nginxWorkingDirectory, "conf.d")
-	upstreamsConfigPath := path.Join(nginxConfigDirectory, "upstreams.conf")
-	_ = upstreamsConfigPath
-	proxyCachesConfigPath := path.Join(nginxConfigDirectory, "proxy_caches.conf")
-	_ = proxyCachesConfigPath
-	fastcgiCachesConfigPath := path.Join(nginxConfigDirectory, "fastcgi_caches.conf")
-	_ = fastcgiCachesConfigPath
-	mapConfigPath := path.Join(nginxConfigDirectory, "maps.conf")
-	_ = mapConfigPath
-
-	cfg, rawCfg, err := file_config.ReadConfig(configFilePath)
-	if err != nil {
-		log.Fatalln("error parsing config file:", err)
-	}
-	_ = cfg
-	_ = rawCfg
-
-	appListeners := strings.Split(mustEnv("DOKKU_APP_LISTENERS"), " ")
-	proxyUpstreamPorts := strings.Split(mustEnv("PROXY_UPSTREAM_PORTS"), " ")
-
-	tmplData := upstreamConfigTemplateData{
-		App:                appName,
-		ProxyUpstreamPorts: proxyUpstreamPorts,
-		AppListeners:       appListeners,
-	}
-
-	upstreamCfgStr, upstreams, err := buildUpstreamConfig(appName, cfg, &tmplData)
-	if err != nil {
-		log.Fatalln("failed to build upstream config:", err)
-	}
-	_ = upstreamCfgStr
-
-	proxyCacheDefaultFlags := make(map[string]string)
-	for _, flag := range strings.Split(os.Getenv("PROXY_CACHE_DEFAULT_FLAGS"), " ") {
-		flagSplit := strings.Split(flag, "=")
-		if len(flagSplit) != 2 {
-			proxyCacheDefaultFlags[flagSplit[0]] = ""
-		} else if len(flagSplit) == 2 {
-			proxyCacheDefaultFlags[flagSplit[0]] = flagSplit[1]
-		} else {
-			log.Fatalln("failed to parse proxy cache default flags:", flag)
+		return
+	case backupsMode:
+		if err := builder.Backups(ctx, opts, flag.Args()[1:], os.Stdin, os.Stdout); err != nil {
+			log.Fatalln(err)
 		}
-	}
-
-	fastcgiCacheDefaultFlags := make(map[string]string)
-	for _, flag := range strings.Split(os.Getenv("FASTCGI_CACHE_DEFAULT_FLAGS"), " ") {
-		flagSplit := strings.Split(flag, "=")
-		if len(flagSplit) != 2 {
-			fastcgiCacheDefaultFlags[flagSplit[0]] = ""
-		} else if len(flagSplit) == 2 {
-			fastcgiCacheDefaultFlags[flagSplit[0]] = flagSplit[1]
-		} else {
-			log.Fatalln("failed to parse fastcgi cache default flags:", flag)
+		return
+	case prune:
+		pruned, err := builder.Prune(ctx, opts)
+		if err != nil {
+			log.Fatalln("failed to prune releases:", err)
 		}
+		for _, dir := range pruned {
+			log.Println("pruned release", filepath.Base(dir))
+		}
+		return
 	}
 
-	buildProxyCacheConfigData := buildProxyCacheConfigData{
-		proxyCacheOnDiskRootPath: mustEnv("PROXY_CACHE_ON_DISK_ROOT_PATH"),
-		proxyCacheInMemRootPath:  mustEnv("PROXY_CACHE_IN_MEM_ROOT_PATH"),
-		proxyCacheDefaultFlags:   proxyCacheDefaultFlags,
-		proxyCacheKeyZoneSize:    mustEnv("PROXY_CACHE_DEFAULT_KEY_ZONE_SIZE"),
-
-		fastcgiOnDiskRootPath: mustEnv("FASTCGI_CACHE_ON_DISK_ROOT_PATH"),
-		fastcgiInMemRootPath:  mustEnv("FASTCGI_CACHE_IN_MEM_ROOT_PATH"),
-		fastcgiDefaultFlags:   fastcgiCacheDefaultFlags,
-		fastcgiKeyZoneSize:    mustEnv("FASTCGI_CACHE_DEFAULT_KEY_ZONE_SIZE"),
-	}
-
-	proxyCacheCfgStr, proxyCaches, err := buildProxyCacheConfig(appName, buildProxyCacheConfigData, cfg)
-	if err != nil {
-		log.Fatalln("failed to build proxy cache config:", err)
-	}
-	_ = proxyCacheCfgStr
-
-	fastcgiCacheCfgStr, fastcgiCaches, err := buildFastcgiCacheConfig(appName, buildProxyCacheConfigData, cfg)
-	if err != nil {
-		log.Fatalln("failed to build fastcgi cache config:", err)
-	}
-	_ = fastcgiCacheCfgStr
+	opts.ProxyUpstreamPorts = strings.Split(mustEnv("PROXY_UPSTREAM_PORTS"), " ")
 
-	mapCfgStr, mapResultingVariables, err := buildMapConfig(appName, cfg)
+	var err error
+	opts.AppListeners, opts.ProcessListeners, err = readAppListeners()
 	if err != nil {
-		log.Fatalln("failed to build map config:", err)
+		log.Fatalln("failed to read app listeners:", err)
 	}
-	_ = mapCfgStr
 
-	locationConfigs, err := buildLocationConfig(appName, cfg, &locationConfigData{
-		upstreams:     upstreams,
-		proxyCaches:   proxyCaches,
-		fastcgiCaches: fastcgiCaches,
-		mapVariables:  mapResultingVariables,
-	})
+	opts.UpstreamAppListeners, err = readUpstreamAppListeners()
 	if err != nil {
-		log.Fatalln("failed to build location config:", err)
+		log.Fatalln("failed to parse upstream app listeners:", err)
 	}
 
-	// Get the latest release directory
-	latestReleaseDir, err := getCurrentConfigVersionDirectory(nginxConfigDirectory)
+	opts.PortMappings, err = builder.ParsePortMap(os.Getenv("PROXY_PORT_MAP"))
 	if err != nil {
-		log.Fatalln("failed to get latest release directory:", err)
+		log.Fatalln("failed to parse proxy port map:", err)
 	}
+	opts.SSLPath = os.Getenv("APP_SSL_PATH")
 
-	// Get the previous version directory (if any)
-	previousDir, err := getPreviousVersionDirectory(nginxConfigDirectory)
-	if err != nil {
-		log.Fatalln("failed to get previous version directory:", err)
+	opts.ProxyCache = builder.CacheOptions{
+		OnDiskRootPath: mustEnv("PROXY_CACHE_ON_DISK_ROOT_PATH"),
+		InMemRootPath:  mustEnv("PROXY_CACHE_IN_MEM_ROOT_PATH"),
+		DefaultFlags:   parseCacheFlags(os.Getenv("PROXY_CACHE_DEFAULT_FLAGS")),
+		KeyZoneSize:    mustEnv("PROXY_CACHE_DEFAULT_KEY_ZONE_SIZE"),
 	}
-
-	// Copy all configuration files to the latest release directory
-	configFiles := map[string]string{
-		"upstreams.conf":      upstreamCfgStr,
-		"proxy_caches.conf":   proxyCacheCfgStr,
-		"fastcgi_caches.conf": fastcgiCacheCfgStr,
-		"maps.conf":           mapCfgStr,
+	opts.FastcgiCache = builder.CacheOptions{
+		OnDiskRootPath: mustEnv("FASTCGI_CACHE_ON_DISK_ROOT_PATH"),
+		InMemRootPath:  mustEnv("FASTCGI_CACHE_IN_MEM_ROOT_PATH"),
+		DefaultFlags:   parseCacheFlags(os.Getenv("FASTCGI_CACHE_DEFAULT_FLAGS")),
+		KeyZoneSize:    mustEnv("FASTCGI_CACHE_DEFAULT_KEY_ZONE_SIZE"),
 	}
 
-	// Copy location configs for each vhost
-	for vhost, locationConfig := range locationConfigs {
-		configFiles[fmt.Sprintf("vhosts/%s/vhost.conf", vhost)] = locationConfig
+	// The source image and git rev are recorded at post-extract
+	opts.SourceImage = os.Getenv("DOKKU_SOURCE_IMAGE")
+	opts.SourceGitRev = os.Getenv("DOKKU_SOURCE_GIT_REV")
+	opts.Env = make(map[string]string, len(manifestEnvKeys))
+	for _, key := range manifestEnvKeys {
+		opts.Env[key] = os.Getenv(key)
 	}
 
-	// Copy all config files to the release directory
-	for filename, content := range configFiles {
-		if err := copyConfigToRelease(content, latestReleaseDir, filename); err != nil {
-			log.Fatalln("failed to copy config file:", err)
+	if plan {
+		changes, err := builder.Plan(ctx, opts, os.Stdout)
+		if err != nil {
+			log.Fatalln(err)
 		}
-	}
-
-	// Update the current symlink to point to the new release
-	if err := updateCurrentSymlink(nginxConfigDirectory, latestReleaseDir); err != nil {
-		log.Fatalln("failed to update current symlink:", err)
-	}
-
-	// Test nginx configuration
-	if !withoutNginxTest {
-		if err := testNginxConfig(nginxTestCommand); err != nil {
-			log.Printf("nginx config test failed, rolling back: %v", err)
-
-			// Rollback to previous version
-			if rollbackErr := rollbackToPrevious(nginxConfigDirectory, previousDir); rollbackErr != nil {
-				log.Fatalln("failed to rollback to previous version:", rollbackErr)
-			}
-
-			log.Fatalln("nginx config test failed, rolled back to previous version:", err)
+		if detailedExitcode && changes.HasChanges() {
+			os.Exit(2)
 		}
+		return
 	}
 
-	log.Println("nginx configuration deployed successfully")
+	if _, err := builder.Build(ctx, opts); err != nil {
+		log.Fatalln(err)
+	}
 }
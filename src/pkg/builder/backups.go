@@ -0,0 +1,530 @@
+package builder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const snapshotTimeFormat = "20060102T150405Z"
+
+// snapshotPattern matches snapshot-<time>.tar.gz, with a -N suffix for the
+// snapshots taken within the same second
+var snapshotPattern = regexp.MustCompile(`^snapshot-(\d{8}T\d{6}Z)(?:-(\d+))?\.tar\.gz$`)
+
+// snapshot is a tar.gz of an app's whole data directory in the backups
+// directory
+type snapshot struct {
+	Path     string
+	TakenAt  time.Time
+	Sequence int
+	Size     int64
+}
+
+// listSnapshots returns the snapshots of backupsDir, oldest first. A missing
+// directory has no snapshots.
+func listSnapshots(backupsDir string) ([]snapshot, error) {
+	entries, err := os.ReadDir(backupsDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backups directory: %w", err)
+	}
+
+	snapshots := make([]snapshot, 0, len(entries))
+	for _, entry := range entries {
+		matches := snapshotPattern.FindStringSubmatch(entry.Name())
+		if len(matches) != 3 || !entry.Type().IsRegular() {
+			continue
+		}
+
+		takenAt, err := time.Parse(snapshotTimeFormat, matches[1])
+		if err != nil {
+			continue
+		}
+		sequence := 0
+		if matches[2] != "" {
+			if sequence, err = strconv.Atoi(matches[2]); err != nil {
+				continue
+			}
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		snapshots = append(snapshots, snapshot{
+			Path:     path.Join(backupsDir, entry.Name()),
+			TakenAt:  takenAt,
+			Sequence: sequence,
+			Size:     info.Size(),
+		})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		if !snapshots[i].TakenAt.Equal(snapshots[j].TakenAt) {
+			return snapshots[i].TakenAt.Before(snapshots[j].TakenAt)
+		}
+		return snapshots[i].Sequence < snapshots[j].Sequence
+	})
+
+	return snapshots, nil
+}
+
+// isLockFile reports whether a file is one of the flock files, which belong
+// to the running processes and are never snapshotted nor restored
+func isLockFile(name string) bool {
+	return strings.HasSuffix(name, ".lock")
+}
+
+// writeSnapshot writes a tar.gz of dataRoot to w: releases, the current
+// symlink, manifests, failed releases and the source YAML. The backups
+// directory and lock files are left out.
+func writeSnapshot(dataRoot string, backupsDir string, w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.WalkDir(dataRoot, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == dataRoot {
+			return nil
+		}
+		if filepath.Clean(file) == filepath.Clean(backupsDir) {
+			return filepath.SkipDir
+		}
+		if isLockFile(entry.Name()) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		linkTarget := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if linkTarget, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, linkTarget)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dataRoot, file)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if entry.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// takeSnapshot saves a snapshot of dataRoot into backupsDir and returns its
+// path. It is written under a temporary name first, so a snapshot in the
+// backups directory is always complete.
+func takeSnapshot(dataRoot string, backupsDir string, now time.Time) (string, error) {
+	if err := os.MkdirAll(backupsDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create backups directory: %w", err)
+	}
+
+	stamp := now.UTC().Format(snapshotTimeFormat)
+	snapshotPath := path.Join(backupsDir, fmt.Sprintf("snapshot-%s.tar.gz", stamp))
+	for sequence := 2; ; sequence++ {
+		if _, err := os.Lstat(snapshotPath); os.IsNotExist(err) {
+			break
+		}
+		snapshotPath = path.Join(backupsDir, fmt.Sprintf("snapshot-%s-%d.tar.gz", stamp, sequence))
+	}
+
+	tmp, err := os.CreateTemp(backupsDir, ".snapshot-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := writeSnapshot(dataRoot, backupsDir, tmp); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), snapshotPath); err != nil {
+		return "", fmt.Errorf("failed to save snapshot: %w", err)
+	}
+
+	return snapshotPath, nil
+}
+
+// pruneSnapshots removes all but the latest count snapshots and returns the
+// removed ones.
+func pruneSnapshots(backupsDir string, count int) ([]string, error) {
+	snapshots, err := listSnapshots(backupsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	pruned := make([]string, 0)
+	for i := 0; i < len(snapshots)-count; i++ {
+		if err := os.Remove(snapshots[i].Path); err != nil {
+			return pruned, fmt.Errorf("failed to remove snapshot %s: %w", snapshots[i].Path, err)
+		}
+		pruned = append(pruned, snapshots[i].Path)
+	}
+	return pruned, nil
+}
+
+// restoreSnapshot replaces the content of dataRoot with the snapshot read
+// from r. The snapshot is extracted next to dataRoot and checked in full
+// before anything is replaced. The backups directory and lock files are kept.
+func restoreSnapshot(dataRoot string, backupsDir string, r io.Reader) error {
+	if err := os.MkdirAll(dataRoot, 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	staging, err := os.MkdirTemp(path.Dir(filepath.Clean(dataRoot)), ".restore-*")
+	if err != nil {
+		return fmt.Errorf("failed to create restore directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	backupsRel, err := filepath.Rel(dataRoot, backupsDir)
+	if err != nil {
+		return fmt.Errorf("failed to locate backups directory: %w", err)
+	}
+	if err := extractSnapshot(staging, backupsRel, r); err != nil {
+		return err
+	}
+
+	if err := removeAllExcept(dataRoot, backupsDir); err != nil {
+		return fmt.Errorf("failed to clear data directory: %w", err)
+	}
+	if err := moveTree(staging, dataRoot); err != nil {
+		return fmt.Errorf("failed to restore data directory: %w", err)
+	}
+	return nil
+}
+
+// extractSnapshot extracts a snapshot into dir. Only directories, regular
+// files and symlinks staying within dir are accepted, entries of the backups
+// directory and lock files are skipped.
+func extractSnapshot(dir string, backupsRel string, r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read snapshot: %w", err)
+		}
+
+		name := filepath.FromSlash(strings.TrimSuffix(header.Name, "/"))
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("invalid snapshot entry %s: outside of the data directory", header.Name)
+		}
+		if name == backupsRel || strings.HasPrefix(name, backupsRel+string(filepath.Separator)) || isLockFile(filepath.Base(name)) {
+			continue
+		}
+		target := filepath.Join(dir, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("failed to extract %s: %w", header.Name, err)
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("failed to extract %s: %w", header.Name, err)
+			}
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fs.FileMode(header.Mode).Perm())
+			if err != nil {
+				return fmt.Errorf("failed to extract %s: %w", header.Name, err)
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("failed to extract %s: %w", header.Name, err)
+			}
+		case tar.TypeSymlink:
+			if filepath.IsAbs(header.Linkname) || !filepath.IsLocal(filepath.Join(filepath.Dir(name), header.Linkname)) {
+				return fmt.Errorf("invalid snapshot entry %s: links outside of the data directory", header.Name)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("failed to extract %s: %w", header.Name, err)
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return fmt.Errorf("failed to extract %s: %w", header.Name, err)
+			}
+		default:
+			return fmt.Errorf("invalid snapshot entry %s: unsupported type %c", header.Name, header.Typeflag)
+		}
+	}
+}
+
+// removeAllExcept removes the content of dir except keep, the directories
+// leading to it, and lock files.
+func removeAllExcept(dir string, keep string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		file := filepath.Join(dir, entry.Name())
+		if filepath.Clean(file) == filepath.Clean(keep) || isLockFile(entry.Name()) {
+			continue
+		}
+		if entry.IsDir() && strings.HasPrefix(filepath.Clean(keep), filepath.Clean(file)+string(filepath.Separator)) {
+			if err := removeAllExcept(file, keep); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.RemoveAll(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveTree moves the content of src into dst, merging into the directories
+// dst already has.
+func moveTree(src string, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		from := filepath.Join(src, entry.Name())
+		to := filepath.Join(dst, entry.Name())
+		if info, err := os.Lstat(to); err == nil && info.IsDir() && entry.IsDir() {
+			if err := moveTree(from, to); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupsCommand holds what the backups subcommands need to act on an app's
+// snapshots.
+type backupsCommand struct {
+	dataRoot             string
+	backupsDir           string
+	nginxConfigDirectory string
+	nginxTestCommand     string
+	reloader             *nginxReloader
+	// locks is nil when the command runs without locking
+	locks *buildLocks
+	in    io.Reader
+	out   io.Writer
+	// log receives the progress messages, out only the data
+	log io.Writer
+}
+
+// run dispatches the backups subcommands:
+//
+//	backups list
+//	backups export [<snapshot>]
+//	backups import
+func (c *backupsCommand) run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing backups subcommand, expected one of list, export, import")
+	}
+
+	switch args[0] {
+	case "list":
+		return c.list()
+	case "export":
+		if len(args) > 2 {
+			return fmt.Errorf("usage: backups export [<snapshot>]")
+		}
+		name := ""
+		if len(args) == 2 {
+			name = args[1]
+		}
+		return c.export(name)
+	case "import":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: backups import")
+		}
+		return c.importSnapshot(ctx)
+	default:
+		return fmt.Errorf("unknown backups subcommand %s, expected one of list, export, import", args[0])
+	}
+}
+
+// list prints the snapshots newest first.
+func (c *backupsCommand) list() error {
+	snapshots, err := listSnapshots(c.backupsDir)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SNAPSHOT\tTAKEN\tSIZE")
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		s := snapshots[i]
+		fmt.Fprintf(w, "%s\t%s\t%d\n", filepath.Base(s.Path), s.TakenAt.Format(time.RFC3339), s.Size)
+	}
+	return w.Flush()
+}
+
+// export writes the named snapshot to out, a fresh snapshot of the app's
+// data directory when name is empty.
+func (c *backupsCommand) export(name string) error {
+	if name != "" {
+		snapshots, err := listSnapshots(c.backupsDir)
+		if err != nil {
+			return err
+		}
+		for _, s := range snapshots {
+			if filepath.Base(s.Path) != name {
+				continue
+			}
+			f, err := os.Open(s.Path)
+			if err != nil {
+				return fmt.Errorf("failed to open snapshot: %w", err)
+			}
+			defer f.Close()
+			if _, err := io.Copy(c.out, f); err != nil {
+				return fmt.Errorf("failed to export snapshot: %w", err)
+			}
+			return nil
+		}
+		return fmt.Errorf("snapshot %s not found", name)
+	}
+
+	if c.locks != nil {
+		appLock, err := c.locks.lockApp()
+		if err != nil {
+			return err
+		}
+		defer appLock.release()
+	}
+	return writeSnapshot(c.dataRoot, c.backupsDir, c.out)
+}
+
+// importSnapshot replaces the app's data directory with the snapshot read
+// from in, then tests and reloads nginx. The data directory is snapshotted
+// first, and restored from that snapshot when the import fails nginx -t or
+// the reload.
+func (c *backupsCommand) importSnapshot(ctx context.Context) error {
+	if c.locks != nil {
+		appLock, err := c.locks.lockApp()
+		if err != nil {
+			return err
+		}
+		defer appLock.release()
+
+		globalLock, err := c.locks.lockGlobal()
+		if err != nil {
+			return err
+		}
+		defer globalLock.release()
+	}
+
+	previous, err := takeSnapshot(c.dataRoot, c.backupsDir, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to snapshot the data directory before the import: %w", err)
+	}
+	fmt.Fprintf(c.log, "saved the data directory as %s\n", filepath.Base(previous))
+
+	if err := restoreSnapshot(c.dataRoot, c.backupsDir, c.in); err != nil {
+		if restoreErr := c.restore(previous); restoreErr != nil {
+			return fmt.Errorf("failed to restore %s after %v: %w", filepath.Base(previous), err, restoreErr)
+		}
+		return fmt.Errorf("import left the data directory unchanged: %w", err)
+	}
+
+	if err := testNginxConfig(ctx, c.nginxTestCommand); err != nil {
+		if restoreErr := c.restore(previous); restoreErr != nil {
+			return fmt.Errorf("failed to restore %s after %v: %w", filepath.Base(previous), err, restoreErr)
+		}
+		return fmt.Errorf("import left the data directory unchanged: %w", err)
+	}
+
+	if err := c.reloader.reload(ctx); err != nil {
+		if restoreErr := c.restore(previous); restoreErr != nil {
+			return fmt.Errorf("failed to restore %s after %v: %w", filepath.Base(previous), err, restoreErr)
+		}
+		if reloadErr := c.reloader.reload(ctx); reloadErr != nil {
+			return fmt.Errorf("failed to reload the restored data directory after %v: %w", err, reloadErr)
+		}
+		return fmt.Errorf("import left the data directory unchanged: %w", err)
+	}
+
+	currentDir, err := getPreviousVersionDirectory(c.nginxConfigDirectory)
+	if err != nil {
+		return err
+	}
+	if currentDir == "" {
+		fmt.Fprintln(c.log, "imported snapshot, it has no current release")
+		return nil
+	}
+	fmt.Fprintf(c.log, "imported snapshot, current release is %s\n", filepath.Base(currentDir))
+	return nil
+}
+
+func (c *backupsCommand) restore(snapshotPath string) error {
+	f, err := os.Open(snapshotPath)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer f.Close()
+	return restoreSnapshot(c.dataRoot, c.backupsDir, f)
+}
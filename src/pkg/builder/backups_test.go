@@ -0,0 +1,250 @@
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTestAppData creates an app data directory with a release, the
+// current symlink, the source YAML, a lock file and a snapshot
+func createTestAppData(t *testing.T, dataRoot string, release string) {
+	t.Helper()
+	files := map[string]string{
+		"nginx-custom-config/conf.d/" + release + "/upstreams.conf":    "# " + release + "\n",
+		"nginx-custom-config-yaml/nginx.yml":                           "# " + release + "\n",
+		"nginx-custom-config/build.lock":                               `{"pid":1}`,
+		"nginx-custom-config/backups/snapshot-20011224T100000Z.tar.gz": "",
+	}
+	for name, content := range files {
+		file := filepath.Join(dataRoot, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatalf("Failed to create directory of %s: %v", name, err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	if err := os.Symlink(release, filepath.Join(dataRoot, "nginx-custom-config/conf.d/current")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+}
+
+func readTestFile(t *testing.T, file string) string {
+	t.Helper()
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", file, err)
+	}
+	return string(content)
+}
+
+func TestSnapshots(t *testing.T) {
+	t.Run("RestoreOnAnotherHost", func(t *testing.T) {
+		source := filepath.Join(t.TempDir(), "app-myapp")
+		createTestAppData(t, source, "release-20011225.1")
+
+		var buf bytes.Buffer
+		if err := writeSnapshot(source, filepath.Join(source, "nginx-custom-config/backups"), &buf); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		target := filepath.Join(t.TempDir(), "app-myapp")
+		createTestAppData(t, target, "release-20011201.1")
+		if err := os.WriteFile(filepath.Join(target, "nginx-custom-config/build.lock"), []byte("held"), 0644); err != nil {
+			t.Fatalf("Failed to write lock file: %v", err)
+		}
+		backupsDir := filepath.Join(target, "nginx-custom-config/backups")
+		if err := restoreSnapshot(target, backupsDir, &buf); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		if current := currentRelease(t, filepath.Join(target, "nginx-custom-config/conf.d")); current != "release-20011225.1" {
+			t.Errorf("Expected current to be release-20011225.1, got: %s", current)
+		}
+		if content := readTestFile(t, filepath.Join(target, "nginx-custom-config/conf.d/current/upstreams.conf")); content != "# release-20011225.1\n" {
+			t.Errorf("Expected restored release config, got: %q", content)
+		}
+		if content := readTestFile(t, filepath.Join(target, "nginx-custom-config-yaml/nginx.yml")); content != "# release-20011225.1\n" {
+			t.Errorf("Expected restored source YAML, got: %q", content)
+		}
+		if _, err := os.Stat(filepath.Join(target, "nginx-custom-config/conf.d/release-20011201.1")); !os.IsNotExist(err) {
+			t.Errorf("Expected the releases of the target to be replaced, got: %v", err)
+		}
+		if content := readTestFile(t, filepath.Join(target, "nginx-custom-config/build.lock")); content != "held" {
+			t.Errorf("Expected lock file to be left alone, got: %q", content)
+		}
+		if _, err := os.Stat(filepath.Join(backupsDir, "snapshot-20011224T100000Z.tar.gz")); err != nil {
+			t.Errorf("Expected backups to be kept, got: %v", err)
+		}
+	})
+
+	t.Run("RejectEscapingEntries", func(t *testing.T) {
+		for _, header := range []*tar.Header{
+			{Name: "../escape.conf", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "nginx-custom-config/conf.d/current", Typeflag: tar.TypeSymlink, Linkname: "../../../etc"},
+			{Name: "nginx-custom-config/conf.d/current", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		} {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			tw := tar.NewWriter(gz)
+			if err := tw.WriteHeader(header); err != nil {
+				t.Fatalf("Failed to write snapshot: %v", err)
+			}
+			tw.Close()
+			gz.Close()
+
+			target := filepath.Join(t.TempDir(), "app-myapp")
+			createTestAppData(t, target, "release-20011201.1")
+			err := restoreSnapshot(target, filepath.Join(target, "nginx-custom-config/backups"), &buf)
+			if err == nil || !strings.Contains(err.Error(), "invalid snapshot entry") {
+				t.Errorf("Expected invalid entry error for %s -> %s, got: %v", header.Name, header.Linkname, err)
+			}
+			if current := currentRelease(t, filepath.Join(target, "nginx-custom-config/conf.d")); current != "release-20011201.1" {
+				t.Errorf("Expected the data directory to be left untouched, got current: %s", current)
+			}
+		}
+	})
+
+	t.Run("TakeAndPrune", func(t *testing.T) {
+		dataRoot := filepath.Join(t.TempDir(), "app-myapp")
+		createTestAppData(t, dataRoot, "release-20011225.1")
+		backupsDir := filepath.Join(dataRoot, "nginx-custom-config/backups")
+
+		for i := 0; i < 3; i++ {
+			if _, err := takeSnapshot(dataRoot, backupsDir, buildTime); err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+		}
+
+		snapshots, err := listSnapshots(backupsDir)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		names := make([]string, 0, len(snapshots))
+		for _, s := range snapshots {
+			names = append(names, filepath.Base(s.Path))
+		}
+		expected := []string{
+			"snapshot-20011224T100000Z.tar.gz",
+			"snapshot-20011225T100000Z.tar.gz",
+			"snapshot-20011225T100000Z-2.tar.gz",
+			"snapshot-20011225T100000Z-3.tar.gz",
+		}
+		if strings.Join(names, " ") != strings.Join(expected, " ") {
+			t.Fatalf("Expected snapshots %v, got: %v", expected, names)
+		}
+
+		pruned, err := pruneSnapshots(backupsDir, 2)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if len(pruned) != 2 || filepath.Base(pruned[1]) != "snapshot-20011225T100000Z.tar.gz" {
+			t.Errorf("Expected the 2 oldest snapshots to be pruned, got: %v", pruned)
+		}
+	})
+}
+
+func newTestBackupsCommand(t *testing.T) (*backupsCommand, *bytes.Buffer) {
+	t.Helper()
+	dataRoot := filepath.Join(t.TempDir(), "app-myapp")
+	createTestAppData(t, dataRoot, "release-20011201.1")
+
+	out := &bytes.Buffer{}
+	return &backupsCommand{
+		dataRoot:             dataRoot,
+		backupsDir:           filepath.Join(dataRoot, "nginx-custom-config/backups"),
+		nginxConfigDirectory: filepath.Join(dataRoot, "nginx-custom-config/conf.d"),
+		nginxTestCommand:     "true",
+		reloader:             newNginxReloader("true", "", time.Second),
+		out:                  out,
+		log:                  &bytes.Buffer{},
+	}, out
+}
+
+func TestBackupsCommand(t *testing.T) {
+	t.Run("ExportImport", func(t *testing.T) {
+		source, exported := newTestBackupsCommand(t)
+		if err := source.run(context.Background(), []string{"export"}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		target, _ := newTestBackupsCommand(t)
+		if err := os.RemoveAll(filepath.Join(target.nginxConfigDirectory, "release-20011201.1")); err != nil {
+			t.Fatalf("Failed to remove release: %v", err)
+		}
+		createTestReleases(t, target.nginxConfigDirectory, "release-20011225.1")
+		if err := updateCurrentSymlink(target.nginxConfigDirectory, filepath.Join(target.nginxConfigDirectory, "release-20011225.1")); err != nil {
+			t.Fatalf("Failed to update symlink: %v", err)
+		}
+
+		target.in = exported
+		if err := target.run(context.Background(), []string{"import"}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if current := currentRelease(t, target.nginxConfigDirectory); current != "release-20011201.1" {
+			t.Errorf("Expected current to be the imported release-20011201.1, got: %s", current)
+		}
+
+		snapshots, err := listSnapshots(target.backupsDir)
+		if err != nil || len(snapshots) != 2 {
+			t.Errorf("Expected a snapshot of the data directory before the import, got: %v (%v)", snapshots, err)
+		}
+	})
+
+	t.Run("ImportFailingTest", func(t *testing.T) {
+		source, exported := newTestBackupsCommand(t)
+		if err := source.run(context.Background(), []string{"export"}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		target, _ := newTestBackupsCommand(t)
+		if err := os.Rename(filepath.Join(target.nginxConfigDirectory, "release-20011201.1"), filepath.Join(target.nginxConfigDirectory, "release-20011225.1")); err != nil {
+			t.Fatalf("Failed to rename release: %v", err)
+		}
+		if err := updateCurrentSymlink(target.nginxConfigDirectory, filepath.Join(target.nginxConfigDirectory, "release-20011225.1")); err != nil {
+			t.Fatalf("Failed to update symlink: %v", err)
+		}
+
+		target.in = exported
+		target.nginxTestCommand = "false"
+		if err := target.run(context.Background(), []string{"import"}); err == nil || !strings.Contains(err.Error(), "import left the data directory unchanged") {
+			t.Fatalf("Expected error for failing nginx test, got: %v", err)
+		}
+		if current := currentRelease(t, target.nginxConfigDirectory); current != "release-20011225.1" {
+			t.Errorf("Expected current to stay release-20011225.1, got: %s", current)
+		}
+	})
+
+	t.Run("ExportSavedSnapshot", func(t *testing.T) {
+		cmd, out := newTestBackupsCommand(t)
+		if err := cmd.run(context.Background(), []string{"export", "snapshot-20011224T100000Z.tar.gz"}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if out.Len() != 0 {
+			t.Errorf("Expected the empty test snapshot, got %d bytes", out.Len())
+		}
+
+		err := cmd.run(context.Background(), []string{"export", "snapshot-20011201T100000Z.tar.gz"})
+		if err == nil || !strings.Contains(err.Error(), "snapshot snapshot-20011201T100000Z.tar.gz not found") {
+			t.Errorf("Expected not found error, got: %v", err)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		cmd, out := newTestBackupsCommand(t)
+		if err := cmd.run(context.Background(), []string{"list"}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != 2 || !strings.HasPrefix(lines[1], "snapshot-20011224T100000Z.tar.gz  2001-12-24T10:00:00Z") {
+			t.Errorf("Expected a header and the snapshot, got:\n%s", out.String())
+		}
+	})
+}
@@ -0,0 +1,548 @@
+package builder
+
+import (
+	"context"
+	"dokku-nginx-custom/src/pkg/file_config"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CacheOptions are the defaults of the proxy or fastcgi caches of a config
+type CacheOptions struct {
+	OnDiskRootPath string
+	InMemRootPath  string
+	DefaultFlags   map[string]string
+	KeyZoneSize    string
+}
+
+// Options are the inputs of a build. Nothing is read from the environment,
+// the nginx-config-builder CLI fills them from the env vars Dokku passes.
+type Options struct {
+	AppName string
+	// ConfigFilePath is the app's nginx-custom YAML config
+	ConfigFilePath string
+	// DataRootDirectory is the app's data directory, releases live in its
+	// <ProxyName>-config directory
+	DataRootDirectory string
+	ProxyName         string
+	// ErrorPagesDirectory holds the plugin's error pages, none are served
+	// when empty
+	ErrorPagesDirectory string
+
+	// ProxyUpstreamPorts are the container ports of the default upstreams
+	ProxyUpstreamPorts []string
+	AppListeners       []Listener
+	// ProcessListeners are the app's listeners keyed by process type
+	ProcessListeners map[string][]Listener
+	// UpstreamAppListeners are the web listeners of the apps referenced by
+	// `app:` upstreams, keyed by app name
+	UpstreamAppListeners map[string][]Listener
+	PortMappings         []PortMapping
+	// SSLPath is the directory holding the app's server.crt and server.key,
+	// empty when the app has no certs
+	SSLPath      string
+	ProxyCache   CacheOptions
+	FastcgiCache CacheOptions
+
+	// SourceImage, SourceGitRev, Env and BuilderVersion are recorded in the
+	// release manifest. Env holds the build inputs as Dokku passed them.
+	SourceImage    string
+	SourceGitRev   string
+	Env            map[string]string
+	BuilderVersion string
+
+	NginxTestCommand   string
+	WithoutNginxTest   bool
+	NginxReloadCommand string
+	WithoutNginxReload bool
+	// NginxPidFile is the nginx master pid file, only the exit code of the
+	// reload command is checked when empty
+	NginxPidFile       string
+	NginxReloadTimeout time.Duration
+	// ProbeAddress is where the config probes are sent, 127.0.0.1 when empty
+	ProbeAddress  string
+	WithoutProbes bool
+	// Force builds and deploys a release even when the config matches
+	// current
+	Force bool
+
+	ReleaseRetentionCount int
+	ReleaseRetentionAge   time.Duration
+	BackupRetentionCount  int
+
+	LockTimeout time.Duration
+	// GlobalLockPath defaults to nginx.lock next to DataRootDirectory
+	GlobalLockPath string
+
+	// Logger receives the progress of the build, log.Default() when nil
+	Logger *log.Logger
+}
+
+// Result describes a successful build
+type Result struct {
+	// Release is the directory the files were written to, the new release
+	// or the output directory of a render
+	Release string
+	// Files are the generated config files, relative to Release
+	Files []string
+	// Upstreams, MapVariables, ProxyCaches and FastcgiCaches map the names
+	// used in the config to the names generated for nginx
+	Upstreams     map[string]string
+	MapVariables  map[string]string
+	ProxyCaches   map[string]string
+	FastcgiCaches map[string]string
+	// Warnings are the problems that did not fail the build
+	Warnings []string
+	// Unchanged is set when the config matched current: no release was
+	// built, nginx was neither tested nor reloaded and Release is current
+	Unchanged bool
+	// Pruned are the releases removed after the build
+	Pruned []string
+}
+
+func (o Options) logger() *log.Logger {
+	if o.Logger == nil {
+		return log.Default()
+	}
+	return o.Logger
+}
+
+func (o Options) workingDirectory() string {
+	return path.Join(o.DataRootDirectory, fmt.Sprintf("%s-config", o.ProxyName))
+}
+
+func (o Options) configDirectory() string {
+	return path.Join(o.workingDirectory(), "conf.d")
+}
+
+func (o Options) backupsDirectory() string {
+	return path.Join(o.workingDirectory(), "backups")
+}
+
+func (o Options) locks() *buildLocks {
+	globalLockPath := o.GlobalLockPath
+	if globalLockPath == "" {
+		globalLockPath = path.Join(path.Dir(path.Clean(o.DataRootDirectory)), "nginx.lock")
+	}
+	return &buildLocks{
+		app:            o.AppName,
+		appLockPath:    path.Join(o.workingDirectory(), "build.lock"),
+		globalLockPath: globalLockPath,
+		timeout:        o.LockTimeout,
+		logger:         o.logger(),
+	}
+}
+
+func (o Options) reloader() *nginxReloader {
+	return newNginxReloader(o.NginxReloadCommand, o.NginxPidFile, o.NginxReloadTimeout)
+}
+
+func (o Options) retention() releaseRetention {
+	return releaseRetention{count: o.ReleaseRetentionCount, maxAge: o.ReleaseRetentionAge}
+}
+
+func (o Options) checkRequired(fields ...string) error {
+	values := map[string]string{
+		"AppName":           o.AppName,
+		"ConfigFilePath":    o.ConfigFilePath,
+		"DataRootDirectory": o.DataRootDirectory,
+		"ProxyName":         o.ProxyName,
+	}
+	for _, field := range fields {
+		if values[field] == "" {
+			return fmt.Errorf("missing required option %s", field)
+		}
+	}
+	return nil
+}
+
+// render renders the config of opts into the config files of a release,
+// keyed by their path relative to the release directory.
+func render(opts Options, cfg *file_config.Config) (map[string]string, *Result, error) {
+	tmplData := upstreamConfigTemplateData{
+		App:                  opts.AppName,
+		ProxyUpstreamPorts:   opts.ProxyUpstreamPorts,
+		AppListeners:         opts.AppListeners,
+		UpstreamAppListeners: opts.UpstreamAppListeners,
+		ProcessListeners:     opts.ProcessListeners,
+	}
+
+	upstreamCfgStr, upstreams, err := buildUpstreamConfig(opts.AppName, cfg, &tmplData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build upstream config: %w", err)
+	}
+
+	cacheData := buildProxyCacheConfigData{
+		proxyCacheOnDiskRootPath: opts.ProxyCache.OnDiskRootPath,
+		proxyCacheInMemRootPath:  opts.ProxyCache.InMemRootPath,
+		proxyCacheDefaultFlags:   opts.ProxyCache.DefaultFlags,
+		proxyCacheKeyZoneSize:    opts.ProxyCache.KeyZoneSize,
+
+		fastcgiOnDiskRootPath: opts.FastcgiCache.OnDiskRootPath,
+		fastcgiInMemRootPath:  opts.FastcgiCache.InMemRootPath,
+		fastcgiDefaultFlags:   opts.FastcgiCache.DefaultFlags,
+		fastcgiKeyZoneSize:    opts.FastcgiCache.KeyZoneSize,
+	}
+
+	proxyCacheCfgStr, proxyCaches, err := buildProxyCacheConfig(opts.AppName, cacheData, cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build proxy cache config: %w", err)
+	}
+
+	fastcgiCacheCfgStr, fastcgiCaches, err := buildFastcgiCacheConfig(opts.AppName, cacheData, cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build fastcgi cache config: %w", err)
+	}
+
+	mapCfgStr, mapResultingVariables, err := buildMapConfig(opts.AppName, cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build map config: %w", err)
+	}
+
+	locationCfgData := &locationConfigData{
+		upstreams:     upstreams,
+		proxyCaches:   proxyCaches,
+		fastcgiCaches: fastcgiCaches,
+		mapVariables:  mapResultingVariables,
+	}
+
+	locationConfigs, err := buildLocationConfig(opts.AppName, cfg, locationCfgData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build location config: %w", err)
+	}
+
+	inHttpBlockCfgStr, err := buildInHttpBlockConfig(cfg, locationCfgData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build in_http_block config: %w", err)
+	}
+
+	serverConfigs, err := buildInServerBlockConfig(opts.AppName, cfg, locationCfgData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build in_server_block config: %w", err)
+	}
+
+	serverBlockData := &serverBlockConfigData{
+		portMappings:        opts.PortMappings,
+		sslPath:             opts.SSLPath,
+		errorPagesDirectory: opts.ErrorPagesDirectory,
+	}
+	serverBlockConfigs, err := buildServerBlockConfig(cfg, locationConfigs, serverConfigs, serverBlockData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build server block config: %w", err)
+	}
+
+	configFiles := map[string]string{
+		"upstreams.conf":      upstreamCfgStr,
+		"proxy_caches.conf":   proxyCacheCfgStr,
+		"fastcgi_caches.conf": fastcgiCacheCfgStr,
+		"maps.conf":           mapCfgStr,
+		"http.conf":           inHttpBlockCfgStr,
+	}
+
+	// Owned vhosts get a complete server block, existing vhosts only get the
+	// location and in_server_block fragments
+	for vhost, locationConfig := range locationConfigs {
+		if serverBlockConfig, ok := serverBlockConfigs[vhost]; ok {
+			configFiles[fmt.Sprintf("vhosts/%s/vhost.conf", vhost)] = serverBlockConfig
+			continue
+		}
+		configFiles[fmt.Sprintf("vhosts/%s/vhost.conf", vhost)] = locationConfig
+		configFiles[fmt.Sprintf("vhosts/%s/server.conf", vhost)] = existingServerConfig(serverConfigs[vhost], opts.ErrorPagesDirectory)
+	}
+
+	files := make([]string, 0, len(configFiles))
+	for filename := range configFiles {
+		files = append(files, filename)
+	}
+	sort.Strings(files)
+
+	return configFiles, &Result{
+		Files:         files,
+		Upstreams:     upstreams,
+		MapVariables:  mapResultingVariables,
+		ProxyCaches:   proxyCaches,
+		FastcgiCaches: fastcgiCaches,
+		Warnings:      append(tmplData.warnings, serverBlockData.warnings...),
+	}, nil
+}
+
+// Build renders the app's config into a new release and deploys it: current
+// is switched to the release, nginx is tested, reloaded and probed, and
+// current goes back to the previous release when any of these fails. The
+// app's data directory is snapshotted beforehand and old releases are pruned
+// afterwards. Nothing is done when the config matches current, unless
+// opts.Force is set.
+func Build(ctx context.Context, opts Options) (*Result, error) {
+	if err := opts.checkRequired("AppName", "ConfigFilePath", "DataRootDirectory", "ProxyName"); err != nil {
+		return nil, err
+	}
+	logger := opts.logger()
+	nginxConfigDirectory := opts.configDirectory()
+
+	// A build owns the app's releases from picking the release directory
+	// to pruning
+	appLock, err := opts.locks().lockApp()
+	if err != nil {
+		return nil, err
+	}
+	defer appLock.release()
+
+	cfg, _, err := file_config.ReadConfig(opts.ConfigFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file: %w", err)
+	}
+
+	if err := file_config.ResolveLocationIncludes(opts.ConfigFilePath, cfg); err != nil {
+		return nil, fmt.Errorf("error resolving location includes: %w", err)
+	}
+
+	configFiles, result, err := render(opts, cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range result.Warnings {
+		logger.Println(warning)
+	}
+
+	// Get the previous version directory (if any)
+	previousDir, err := getPreviousVersionDirectory(nginxConfigDirectory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get previous version directory: %w", err)
+	}
+
+	// Rendering is deterministic, a config matching current needs neither a
+	// release nor a reload
+	if previousDir != "" && !opts.Force {
+		unchanged, err := releaseMatches(previousDir, opts, cfg.Probes, configFiles)
+		if err != nil {
+			logger.Println("failed to compare the config with current, building anyway:", err)
+		}
+		if unchanged {
+			logger.Println("config unchanged, current stays", filepath.Base(previousDir))
+			result.Release = previousDir
+			result.Unchanged = true
+			return result, nil
+		}
+	}
+
+	// A failing snapshot only loses a restore point, the build goes on
+	if snapshotPath, err := takeSnapshot(opts.DataRootDirectory, opts.backupsDirectory(), time.Now()); err != nil {
+		logger.Println("failed to snapshot config before the build:", err)
+	} else {
+		logger.Println("saved config snapshot", filepath.Base(snapshotPath))
+		prunedSnapshots, err := pruneSnapshots(opts.backupsDirectory(), opts.BackupRetentionCount)
+		if err != nil {
+			logger.Println("failed to prune snapshots:", err)
+		}
+		for _, snapshotPath := range prunedSnapshots {
+			logger.Println("pruned snapshot", filepath.Base(snapshotPath))
+		}
+	}
+
+	// Every build gets a fresh release directory, current keeps pointing at
+	// the previous one until the new release is complete
+	builtAt := time.Now()
+	latestReleaseDir, err := getNextReleaseDirectory(nginxConfigDirectory, builtAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get next release directory: %w", err)
+	}
+	result.Release = latestReleaseDir
+
+	// Copy all config files to the release directory
+	for filename, content := range configFiles {
+		if err := copyConfigToRelease(content, latestReleaseDir, filename); err != nil {
+			return nil, fmt.Errorf("failed to copy config file: %w", err)
+		}
+	}
+
+	manifest, err := newReleaseManifest(opts, cfg.Probes, configFiles, builtAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build release manifest: %w", err)
+	}
+	if err := writeReleaseManifest(latestReleaseDir, manifest); err != nil {
+		return nil, fmt.Errorf("failed to write release manifest: %w", err)
+	}
+
+	if err := deployRelease(ctx, opts, cfg, manifest, latestReleaseDir, previousDir); err != nil {
+		return nil, err
+	}
+
+	logger.Println("nginx configuration deployed successfully")
+
+	// A failing prune leaves extra releases around, the deploy itself is done
+	pruned, err := pruneReleases(nginxConfigDirectory, opts.retention(), time.Now())
+	if err != nil {
+		logger.Println("failed to prune releases:", err)
+	}
+	for _, dir := range pruned {
+		logger.Println("pruned release", filepath.Base(dir))
+	}
+	result.Pruned = pruned
+
+	return result, nil
+}
+
+// deployRelease points current at the release and tests, reloads and probes
+// nginx under the global lock. On failure current goes back to previousDir
+// and the release is quarantined.
+func deployRelease(ctx context.Context, opts Options, cfg *file_config.Config, manifest *releaseManifest, releaseDir string, previousDir string) error {
+	logger := opts.logger()
+	nginxConfigDirectory := opts.configDirectory()
+
+	globalLock, err := opts.locks().lockGlobal()
+	if err != nil {
+		return err
+	}
+	defer globalLock.release()
+
+	// quarantine moves the release out of the way once current is back on
+	// the previous release, keeping what is needed to debug the failure
+	quarantine := func(stage string, err error) {
+		failure := releaseFailure{FailedAt: time.Now(), Stage: stage, Error: err.Error()}
+		if qErr := quarantineRelease(nginxConfigDirectory, releaseDir, opts.ConfigFilePath, failure); qErr != nil {
+			logger.Println("failed to quarantine release:", qErr)
+			return
+		}
+		logger.Printf("failed release moved to %s", path.Join(failedReleasesDirectory(nginxConfigDirectory), filepath.Base(releaseDir)))
+	}
+
+	// Update the current symlink to point to the new release
+	if err := updateCurrentSymlink(nginxConfigDirectory, releaseDir); err != nil {
+		return fmt.Errorf("failed to update current symlink: %w", err)
+	}
+
+	// Test nginx configuration
+	if !opts.WithoutNginxTest {
+		if err := testNginxConfig(ctx, opts.NginxTestCommand); err != nil {
+			logger.Printf("nginx config test failed, rolling back: %v", err)
+
+			// Rollback to previous version
+			if rollbackErr := rollbackToPrevious(nginxConfigDirectory, previousDir); rollbackErr != nil {
+				return fmt.Errorf("failed to rollback to previous version: %w", rollbackErr)
+			}
+			quarantine(failureStageNginxTest, err)
+
+			return fmt.Errorf("nginx config test failed, rolled back to previous version: %w", err)
+		}
+	}
+
+	if opts.WithoutNginxReload {
+		return nil
+	}
+
+	reloader := opts.reloader()
+	if err := reloader.reload(ctx); err != nil {
+		logger.Printf("nginx reload failed, rolling back: %v", err)
+
+		if rollbackErr := rollbackToPrevious(nginxConfigDirectory, previousDir); rollbackErr != nil {
+			return fmt.Errorf("failed to rollback to previous version: %w", rollbackErr)
+		}
+		// current is back on the previous release either way, the failed
+		// release is quarantined before reporting the second reload failure
+		reloadErr := reloader.reload(ctx)
+		quarantine(failureStageReload, err)
+		if reloadErr != nil {
+			return fmt.Errorf("failed to reload the previous version: %w", reloadErr)
+		}
+
+		return fmt.Errorf("nginx reload failed, rolled back to previous version: %w", err)
+	}
+
+	// Probes only make sense once the new release is live
+	if len(cfg.Probes) == 0 || opts.WithoutProbes {
+		return nil
+	}
+
+	probeAddress := opts.ProbeAddress
+	if probeAddress == "" {
+		probeAddress = "127.0.0.1"
+	}
+	results, passed := newProber(probeAddress, opts.PortMappings).run(ctx, cfg.Probes)
+	manifest.Probes = results
+	if err := writeReleaseManifest(releaseDir, manifest); err != nil {
+		logger.Println("failed to write probe results to release manifest:", err)
+	}
+	if passed {
+		return nil
+	}
+
+	failures := make([]string, 0, len(results))
+	for _, result := range results {
+		if !result.Passed {
+			failures = append(failures, fmt.Sprintf("probe %s%s failed: %s", result.Host, result.Path, result.Error))
+		}
+	}
+	logger.Println(strings.Join(failures, "\n"))
+
+	if rollbackErr := rollbackToPrevious(nginxConfigDirectory, previousDir); rollbackErr != nil {
+		return fmt.Errorf("failed to rollback to previous version: %w", rollbackErr)
+	}
+	reloadErr := reloader.reload(ctx)
+	quarantine(failureStageProbes, errors.New(strings.Join(failures, "\n")))
+	if reloadErr != nil {
+		return fmt.Errorf("failed to reload the previous version: %w", reloadErr)
+	}
+
+	return fmt.Errorf("nginx config probes failed, rolled back to previous version")
+}
+
+// Prune removes the app's releases falling out of retention and returns the
+// removed release directories.
+func Prune(ctx context.Context, opts Options) ([]string, error) {
+	if err := opts.checkRequired("DataRootDirectory", "ProxyName"); err != nil {
+		return nil, err
+	}
+
+	appLock, err := opts.locks().lockApp()
+	if err != nil {
+		return nil, err
+	}
+	defer appLock.release()
+
+	return pruneReleases(opts.configDirectory(), opts.retention(), time.Now())
+}
+
+// Releases runs one of the releases subcommands on the app's releases: list,
+// rollback, diff or last-failure.
+func Releases(ctx context.Context, opts Options, args []string, out io.Writer) error {
+	if err := opts.checkRequired("DataRootDirectory", "ProxyName"); err != nil {
+		return err
+	}
+
+	cmd := &releasesCommand{
+		nginxConfigDirectory: opts.configDirectory(),
+		nginxTestCommand:     opts.NginxTestCommand,
+		reloader:             opts.reloader(),
+		locks:                opts.locks(),
+		out:                  out,
+	}
+	return cmd.run(ctx, args)
+}
+
+// Backups runs one of the backups subcommands on the app's snapshots: list,
+// export or import. Snapshots are imported from in and exported to out.
+func Backups(ctx context.Context, opts Options, args []string, in io.Reader, out io.Writer) error {
+	if err := opts.checkRequired("DataRootDirectory", "ProxyName"); err != nil {
+		return err
+	}
+
+	cmd := &backupsCommand{
+		dataRoot:             opts.DataRootDirectory,
+		backupsDir:           opts.backupsDirectory(),
+		nginxConfigDirectory: opts.configDirectory(),
+		nginxTestCommand:     opts.NginxTestCommand,
+		reloader:             opts.reloader(),
+		locks:                opts.locks(),
+		in:                   in,
+		out:                  out,
+		log:                  opts.logger().Writer(),
+	}
+	return cmd.run(ctx, args)
+}
@@ -0,0 +1,358 @@
+package builder
+
+import (
+	"context"
+	"dokku-nginx-custom/src/pkg/file_config"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBuildConfig = `vhosts:
+  - server_name: api.example.com
+    locations:
+      - uri: /
+        body: proxy_pass http://{{ .upstreams.default }};
+`
+
+func newTestBuildOptions(t *testing.T) Options {
+	t.Helper()
+	tempDir := t.TempDir()
+	configFilePath := filepath.Join(tempDir, "nginx.yml")
+	if err := os.WriteFile(configFilePath, []byte(testBuildConfig), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	return Options{
+		AppName:            "app",
+		ConfigFilePath:     configFilePath,
+		DataRootDirectory:  filepath.Join(tempDir, "app-app"),
+		ProxyName:          "nginx-custom",
+		ProxyUpstreamPorts: []string{"5000"},
+		AppListeners:       []Listener{{Host: "172.17.0.2", ProcessType: "web"}},
+		PortMappings:       []PortMapping{{Scheme: "http", ListenPort: "80", UpstreamPort: "5000"}},
+		NginxTestCommand:   "true",
+		WithoutNginxReload: true,
+		LockTimeout:        time.Second,
+		Logger:             log.New(io.Discard, "", 0),
+	}
+}
+
+func TestBuild(t *testing.T) {
+	t.Run("Deploy", func(t *testing.T) {
+		opts := newTestBuildOptions(t)
+		result, err := Build(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		if current := currentRelease(t, opts.configDirectory()); current != filepath.Base(result.Release) {
+			t.Errorf("Expected current to point at %s, got: %s", filepath.Base(result.Release), current)
+		}
+		if result.Upstreams["default"] != "app-5000" {
+			t.Errorf("Expected default upstream app-5000, got: %v", result.Upstreams)
+		}
+		if !strings.Contains(strings.Join(result.Files, " "), "vhosts/api.example.com/vhost.conf") {
+			t.Errorf("Expected the vhost config among the files, got: %v", result.Files)
+		}
+
+		vhostConf, err := os.ReadFile(filepath.Join(result.Release, "vhosts/api.example.com/vhost.conf"))
+		if err != nil {
+			t.Fatalf("Failed to read vhost config: %v", err)
+		}
+		if !strings.Contains(string(vhostConf), "proxy_pass http://app-5000;") {
+			t.Errorf("Expected vhost config to proxy to app-5000, got:\n%s", vhostConf)
+		}
+		if manifest, err := readReleaseManifest(result.Release); err != nil || manifest == nil {
+			t.Errorf("Expected a release manifest, got: %v", err)
+		}
+	})
+
+	t.Run("Warnings", func(t *testing.T) {
+		opts := newTestBuildOptions(t)
+		opts.AppListeners = nil
+		result, err := Build(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "upstream app-5000 has no servers") {
+			t.Errorf("Expected a warning for the empty upstream, got: %v", result.Warnings)
+		}
+	})
+
+	t.Run("FailingTest", func(t *testing.T) {
+		opts := newTestBuildOptions(t)
+		first, err := Build(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		opts.NginxTestCommand = "echo 'nginx: [emerg] invalid config' >&2; false"
+		opts.Force = true
+		if _, err := Build(context.Background(), opts); err == nil || !strings.Contains(err.Error(), "rolled back to previous version") {
+			t.Fatalf("Expected rollback error, got: %v", err)
+		}
+
+		if current := currentRelease(t, opts.configDirectory()); current != filepath.Base(first.Release) {
+			t.Errorf("Expected current to stay %s, got: %s", filepath.Base(first.Release), current)
+		}
+		failed := remainingReleases(t, failedReleasesDirectory(opts.configDirectory()))
+		if len(failed) != 1 {
+			t.Fatalf("Expected the failed release to be quarantined, got: %v", failed)
+		}
+		failure, err := readReleaseFailure(filepath.Join(failedReleasesDirectory(opts.configDirectory()), failed[0]))
+		if err != nil || !strings.Contains(failure.Error, "invalid config") {
+			t.Errorf("Expected the nginx -t output to be recorded, got: %+v (%v)", failure, err)
+		}
+	})
+
+	t.Run("FailingReloadOfPrevious", func(t *testing.T) {
+		opts := newTestBuildOptions(t)
+		first, err := Build(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		// both the reload of the new release and the one of the previous fail
+		opts.WithoutNginxReload = false
+		opts.NginxReloadCommand = "echo 'nginx: [emerg] reload failed' >&2; false"
+		opts.Force = true
+		if _, err := Build(context.Background(), opts); err == nil || !strings.Contains(err.Error(), "failed to reload the previous version") {
+			t.Fatalf("Expected previous reload error, got: %v", err)
+		}
+
+		if current := currentRelease(t, opts.configDirectory()); current != filepath.Base(first.Release) {
+			t.Errorf("Expected current to stay %s, got: %s", filepath.Base(first.Release), current)
+		}
+		if releases := remainingReleases(t, opts.configDirectory()); len(releases) != 1 {
+			t.Errorf("Expected the failed release to leave conf.d, got: %v", releases)
+		}
+		failed := remainingReleases(t, failedReleasesDirectory(opts.configDirectory()))
+		if len(failed) != 1 {
+			t.Fatalf("Expected the failed release to be quarantined, got: %v", failed)
+		}
+		failure, err := readReleaseFailure(filepath.Join(failedReleasesDirectory(opts.configDirectory()), failed[0]))
+		if err != nil || failure.Stage != failureStageReload || !strings.Contains(failure.Error, "reload failed") {
+			t.Errorf("Expected the reload failure to be recorded, got: %+v (%v)", failure, err)
+		}
+	})
+
+	t.Run("FailingFirstBuild", func(t *testing.T) {
+		opts := newTestBuildOptions(t)
+		opts.NginxTestCommand = "false"
+		if _, err := Build(context.Background(), opts); err == nil {
+			t.Fatalf("Expected the build to fail")
+		}
+
+		// current stays around, pointing at a release without any config
+		if current := currentRelease(t, opts.configDirectory()); current != emptyReleaseName {
+			t.Errorf("Expected current to point at %s, got: %s", emptyReleaseName, current)
+		}
+		if entries, err := os.ReadDir(filepath.Join(opts.configDirectory(), "current")); err != nil || len(entries) != 0 {
+			t.Errorf("Expected current to hold no config, got: %v (%v)", entries, err)
+		}
+
+		opts.NginxTestCommand = "true"
+		result, err := Build(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if current := currentRelease(t, opts.configDirectory()); current != filepath.Base(result.Release) {
+			t.Errorf("Expected current to point at %s, got: %s", filepath.Base(result.Release), current)
+		}
+	})
+
+	t.Run("Unchanged", func(t *testing.T) {
+		opts := newTestBuildOptions(t)
+		first, err := Build(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		snapshots, err := listSnapshots(opts.backupsDirectory())
+		if err != nil {
+			t.Fatalf("Failed to list snapshots: %v", err)
+		}
+
+		// an unchanged config is neither tested nor reloaded
+		opts.NginxTestCommand = "false"
+		opts.WithoutNginxReload = false
+		opts.NginxReloadCommand = "false"
+		second, err := Build(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if !second.Unchanged || second.Release != first.Release {
+			t.Errorf("Expected the build to keep %s, got: %+v", first.Release, second)
+		}
+		if releases := remainingReleases(t, opts.configDirectory()); len(releases) != 1 {
+			t.Errorf("Expected no new release, got: %v", releases)
+		}
+		if after, err := listSnapshots(opts.backupsDirectory()); err != nil || len(after) != len(snapshots) {
+			t.Errorf("Expected no new snapshot, got: %v (%v)", after, err)
+		}
+
+		opts.NginxTestCommand = "true"
+		opts.NginxReloadCommand = "true"
+		opts.AppListeners = append(opts.AppListeners, Listener{Host: "172.17.0.3", ProcessType: "web"})
+		third, err := Build(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if third.Unchanged || third.Release == first.Release {
+			t.Errorf("Expected a new release for the changed config, got: %+v", third)
+		}
+	})
+
+	t.Run("UnchangedFilesWithOtherInputs", func(t *testing.T) {
+		for name, change := range map[string]func(opts *Options){
+			"Probes": func(opts *Options) {
+				probes := testBuildConfig + "probes:\n  - path: /\n    host: api.example.com\n"
+				if err := os.WriteFile(opts.ConfigFilePath, []byte(probes), 0644); err != nil {
+					t.Fatalf("Failed to write config file: %v", err)
+				}
+			},
+			"Env":            func(opts *Options) { opts.Env = map[string]string{"PROXY_PORT_MAP": "http:80:5000"} },
+			"BuilderVersion": func(opts *Options) { opts.BuilderVersion = "0.2.0" },
+		} {
+			t.Run(name, func(t *testing.T) {
+				opts := newTestBuildOptions(t)
+				opts.BuilderVersion = "0.1.0"
+				first, err := Build(context.Background(), opts)
+				if err != nil {
+					t.Fatalf("Expected no error, got: %v", err)
+				}
+
+				// the rendered files stay the same, the release has to differ
+				change(&opts)
+				result, err := Build(context.Background(), opts)
+				if err != nil {
+					t.Fatalf("Expected no error, got: %v", err)
+				}
+				if result.Unchanged || result.Release == first.Release {
+					t.Errorf("Expected a new release, got: %+v", result)
+				}
+			})
+		}
+	})
+
+	t.Run("UnchangedWithNewCerts", func(t *testing.T) {
+		opts := newTestBuildOptions(t)
+		opts.SSLPath = t.TempDir()
+		for _, filename := range []string{"server.crt", "server.key"} {
+			if err := os.WriteFile(filepath.Join(opts.SSLPath, filename), []byte("old "+filename), 0600); err != nil {
+				t.Fatalf("Failed to write %s: %v", filename, err)
+			}
+		}
+		if _, err := Build(context.Background(), opts); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		// nginx only picks renewed certs up on a reload
+		if err := os.WriteFile(filepath.Join(opts.SSLPath, "server.crt"), []byte("new server.crt"), 0600); err != nil {
+			t.Fatalf("Failed to write server.crt: %v", err)
+		}
+		result, err := Build(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if result.Unchanged {
+			t.Errorf("Expected a new release for the renewed cert")
+		}
+
+		opts.Force = true
+		if result, err := Build(context.Background(), opts); err != nil || result.Unchanged {
+			t.Errorf("Expected a forced build to deploy a release, got: %+v (%v)", result, err)
+		}
+	})
+
+	t.Run("MissingOptions", func(t *testing.T) {
+		if _, err := Build(context.Background(), Options{AppName: "app"}); err == nil || !strings.Contains(err.Error(), "missing required option ConfigFilePath") {
+			t.Errorf("Expected missing option error, got: %v", err)
+		}
+	})
+}
+
+func TestRenderDeterministic(t *testing.T) {
+	const config = `upstreams:
+  - select_default: true
+    default_servers_flags:
+      - flags:
+          max_fails: "3"
+          fail_timeout: 10s
+          weight: "2"
+  - name: zeta
+    servers:
+      - addr: 127.0.0.1:8002
+        flags:
+          weight: "5"
+          backup: ""
+          max_conns: "100"
+  - name: alpha
+    servers:
+      - addr: 127.0.0.1:8001
+proxy_caches:
+  - name: pages
+    flags:
+      levels: "1:2"
+      inactive: 60m
+      use_temp_path: "off"
+fastcgi_caches:
+  - name: php
+    flags:
+      levels: "1:2"
+      inactive: 10m
+vhosts:
+  - server_name: api.example.com
+    locations:
+      - uri: /
+        body: proxy_pass http://{{ .upstreams.default }};
+`
+	opts := newTestBuildOptions(t)
+	if err := os.WriteFile(opts.ConfigFilePath, []byte(config), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	opts.ProxyCache = CacheOptions{OnDiskRootPath: "/var/cache/proxy", KeyZoneSize: "10m", DefaultFlags: map[string]string{"max_size": "1g"}}
+	opts.FastcgiCache = CacheOptions{OnDiskRootPath: "/var/cache/fastcgi", KeyZoneSize: "10m"}
+
+	cfg, _, err := file_config.ReadConfig(opts.ConfigFilePath)
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+
+	first, _, err := render(opts, cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		configFiles, _, err := render(opts, cfg)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if !reflect.DeepEqual(configFiles, first) {
+			t.Fatalf("Expected every render to match the first one, got:\n%v\nthen:\n%v", first, configFiles)
+		}
+	}
+
+	expectedUpstreams := "upstream app-5000 {\n  server 172.17.0.2:5000 fail_timeout=10s max_fails=3 weight=2;\n}\n" +
+		"upstream app-alpha {\n  server 127.0.0.1:8001;\n}\n" +
+		"upstream app-zeta {\n  server 127.0.0.1:8002 backup max_conns=100 weight=5;\n}\n"
+	if first["upstreams.conf"] != expectedUpstreams {
+		t.Errorf("Expected upstreams sorted by name with sorted flags:\n%s\ngot:\n%s", expectedUpstreams, first["upstreams.conf"])
+	}
+
+	expectedProxyCaches := "proxy_cache_path /var/cache/proxy/app_pages keys_zone=app_pages:10m inactive=60m levels=1:2 max_size=1g use_temp_path=off;"
+	if first["proxy_caches.conf"] != expectedProxyCaches {
+		t.Errorf("Expected proxy cache flags sorted by name:\n%s\ngot:\n%s", expectedProxyCaches, first["proxy_caches.conf"])
+	}
+
+	expectedFastcgiCaches := "fastcgi_cache_path /var/cache/fastcgi/app_php keys_zone=app_php:10m inactive=10m levels=1:2;"
+	if first["fastcgi_caches.conf"] != expectedFastcgiCaches {
+		t.Errorf("Expected fastcgi cache flags sorted by name:\n%s\ngot:\n%s", expectedFastcgiCaches, first["fastcgi_caches.conf"])
+	}
+}
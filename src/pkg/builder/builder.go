@@ -0,0 +1,984 @@
+package builder
+
+import (
+	"context"
+	"dokku-nginx-custom/src/pkg/file_config"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"dario.cat/mergo"
+	"github.com/gliderlabs/sigil"
+	_ "github.com/gliderlabs/sigil/builtin"
+)
+
+type upstreamConfigTemplateData struct {
+	ProxyUpstreamPorts []string   `json:"ProxyUpstreamPorts"`
+	AppListeners       []Listener `json:"AppListeners"`
+	App                string     `json:"App"`
+	// UpstreamAppListeners holds the web listeners of the apps referenced
+	// by `app:` upstreams, keyed by app name
+	UpstreamAppListeners map[string][]Listener `json:"UpstreamAppListeners"`
+	// ProcessListeners holds the app's listeners of the process types
+	// selected by `select_process:` upstreams, keyed by process type
+	ProcessListeners map[string][]Listener `json:"ProcessListeners"`
+
+	// warnings collects the problems that do not fail the build
+	warnings []string
+}
+
+type upstreamServer struct {
+	Addr        string            `json:"addr"`
+	Flags       map[string]string `json:"flags"`
+	FlagsString string            `json:"flagsString"`
+	// Listener is the container behind the server, nil for user-supplied
+	// servers
+	Listener *Listener `json:"listener"`
+}
+
+type upstreamConfig struct {
+	GeneratedUpstreamName string           `json:"generatedUpstreamName"`
+	Servers               []upstreamServer `json:"servers"`
+	Directives            []string         `json:"directives"`
+	// Placeholder is set when there was no server to proxy to, the upstream
+	// then holds a single down server so requests fail with a 502
+	Placeholder bool `json:"placeholder"`
+}
+
+// placeholderUpstreamServer keeps an upstream without running containers
+// valid for nginx -t. It is never contacted.
+var placeholderUpstreamServer = upstreamServer{
+	Addr:        "127.0.0.1:1",
+	FlagsString: "down",
+}
+
+// buildUpstreamDirectives returns the upstream-level directives of an
+// upstream config. The load-balancing method must come before keepalive.
+func buildUpstreamDirectives(upstreamCfg *file_config.UpstreamConfig, generatedUpstreamName string) []string {
+	directives := make([]string, 0)
+
+	if upstreamCfg.Zone != "" {
+		directives = append(directives, fmt.Sprintf("zone %s %s", generatedUpstreamName, upstreamCfg.Zone))
+	}
+
+	switch {
+	case upstreamCfg.LeastConn:
+		directives = append(directives, "least_conn")
+	case upstreamCfg.IpHash:
+		directives = append(directives, "ip_hash")
+	case upstreamCfg.Hash != nil:
+		directive := fmt.Sprintf("hash %s", upstreamCfg.Hash.Key)
+		if upstreamCfg.Hash.Consistent {
+			directive += " consistent"
+		}
+		directives = append(directives, directive)
+	case upstreamCfg.Random != nil:
+		directive := "random"
+		if upstreamCfg.Random.Two {
+			directive += " two"
+			if upstreamCfg.Random.Method != "" {
+				directive += " " + upstreamCfg.Random.Method
+			}
+		}
+		directives = append(directives, directive)
+	case upstreamCfg.Sticky != nil:
+		directives = append(directives, stickyHashDirective(upstreamCfg.Sticky))
+	}
+
+	if upstreamCfg.Keepalive != nil {
+		directives = append(directives, fmt.Sprintf("keepalive %d", upstreamCfg.Keepalive.Connections))
+		if upstreamCfg.Keepalive.Timeout != "" {
+			directives = append(directives, fmt.Sprintf("keepalive_timeout %s", upstreamCfg.Keepalive.Timeout))
+		}
+		if upstreamCfg.Keepalive.Requests != 0 {
+			directives = append(directives, fmt.Sprintf("keepalive_requests %d", upstreamCfg.Keepalive.Requests))
+		}
+	}
+
+	return directives
+}
+
+// stickyHashDirective renders a sticky preset as a consistent hash, so that
+// only a share of the clients move when servers are added or removed.
+func stickyHashDirective(sticky *file_config.UpstreamSticky) string {
+	var key string
+	switch {
+	case sticky.Cookie != "":
+		key = "$cookie_" + sticky.Cookie
+	case sticky.Header != "":
+		key = "$http_" + strings.ReplaceAll(strings.ToLower(sticky.Header), "-", "_")
+	default:
+		key = "$remote_addr"
+	}
+	return fmt.Sprintf("hash %s consistent", key)
+}
+
+type upstreamResultingNames map[string]string
+
+// serverMatchesSelector reports whether a server matches every criterion set
+// on a server flags selector. Container criteria never match user-supplied
+// servers.
+func serverMatchesSelector(server upstreamServer, serverFlagCfg file_config.UpstreamServerFlags) (bool, error) {
+	if serverFlagCfg.Selector != "" {
+		regex, err := regexp.Compile(serverFlagCfg.Selector)
+		if err != nil {
+			return false, fmt.Errorf("failed to compile regex: %v", err)
+		}
+		if !regex.MatchString(server.Addr) {
+			return false, nil
+		}
+	}
+
+	if serverFlagCfg.ContainerIndex == 0 && serverFlagCfg.ContainerName == "" && serverFlagCfg.ProcessType == "" {
+		return true, nil
+	}
+
+	if server.Listener == nil {
+		return false, nil
+	}
+
+	if serverFlagCfg.ContainerIndex != 0 && server.Listener.ContainerIndex != serverFlagCfg.ContainerIndex {
+		return false, nil
+	}
+
+	if serverFlagCfg.ContainerName != "" {
+		matched, err := path.Match(serverFlagCfg.ContainerName, server.Listener.ContainerName)
+		if err != nil {
+			return false, fmt.Errorf("invalid container_name glob %s: %w", serverFlagCfg.ContainerName, err)
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+
+	if serverFlagCfg.ProcessType != "" && server.Listener.ProcessType != serverFlagCfg.ProcessType {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// applyServersFlags merges the flags of every matching selector into the
+// servers of an upstream. A selector without any criterion matches all
+// servers.
+func applyServersFlags(uc *upstreamConfig, serversFlags []file_config.UpstreamServerFlags) error {
+	for _, serverFlagCfg := range serversFlags {
+		for i, server := range uc.Servers {
+			matched, err := serverMatchesSelector(server, serverFlagCfg)
+			if err != nil {
+				return err
+			}
+			if matched {
+				mergo.Merge(&uc.Servers[i].Flags, serverFlagCfg.Flags, mergo.WithOverride)
+			}
+		}
+	}
+	return nil
+}
+
+// listenerServers turns listeners into upstream servers on the given port.
+func listenerServers(listeners []Listener, port string) ([]upstreamServer, error) {
+	servers := make([]upstreamServer, 0, len(listeners))
+	for i := range listeners {
+		upstreamAddr, err := listeners[i].addr(port)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, upstreamServer{
+			Addr:     upstreamAddr,
+			Listener: &listeners[i],
+		})
+	}
+	return servers, nil
+}
+
+func buildUpstreamConfig(appName string, config *file_config.Config, data *upstreamConfigTemplateData) (string, upstreamResultingNames, error) {
+	upstreamConfigs := make(map[string]*upstreamConfig, 0)
+
+	upstreamResultingNames := make(upstreamResultingNames, 0)
+
+	// default upstreams
+	for _, port := range data.ProxyUpstreamPorts {
+		refName := fmt.Sprintf("default-%s", port)
+		generatedUpstreamName := fmt.Sprintf("%s-%s", appName, port)
+		upstreamResultingNames[refName] = generatedUpstreamName
+
+		if _, ok := upstreamResultingNames["default"]; !ok {
+			upstreamResultingNames["default"] = generatedUpstreamName
+		}
+
+		upstreamMapKey := fmt.Sprintf("default-%s", port)
+		servers, err := listenerServers(data.AppListeners, port)
+		if err != nil {
+			return "", nil, err
+		}
+		upstreamConfigs[upstreamMapKey] = &upstreamConfig{
+			GeneratedUpstreamName: generatedUpstreamName,
+			Servers:               servers,
+		}
+	}
+
+	// process type upstreams
+	for _, upstreamCfg := range config.Upstreams {
+		if upstreamCfg.SelectProcess == "" {
+			continue
+		}
+
+		processType := upstreamCfg.SelectProcess
+		port := strconv.Itoa(upstreamCfg.SelectProcessPort)
+		for _, upstream := range config.Upstreams {
+			if upstream.Name == processType {
+				return "", nil, fmt.Errorf("upstream name %s conflicts with the %s process type upstream", upstream.Name, processType)
+			}
+		}
+
+		generatedUpstreamName := fmt.Sprintf("%s-%s-%s", appName, processType, port)
+		upstreamResultingNames[fmt.Sprintf("%s-%s", processType, port)] = generatedUpstreamName
+		if _, ok := upstreamResultingNames[processType]; !ok {
+			upstreamResultingNames[processType] = generatedUpstreamName
+		}
+
+		servers, err := listenerServers(data.ProcessListeners[processType], port)
+		if err != nil {
+			return "", nil, fmt.Errorf("process type %s: %w", processType, err)
+		}
+		upstreamConfigs[fmt.Sprintf("process-%s-%s", processType, port)] = &upstreamConfig{
+			GeneratedUpstreamName: generatedUpstreamName,
+			Servers:               servers,
+		}
+	}
+
+	// user-supplied upstreams
+	for _, upstream := range config.Upstreams {
+		if upstream.Name == "" {
+			continue
+		}
+		generatedUpstreamName := fmt.Sprintf("%s-%s", appName, upstream.Name)
+		upstreamConfigs[upstream.Name] = &upstreamConfig{
+			GeneratedUpstreamName: generatedUpstreamName,
+		}
+		upstreamResultingNames[upstream.Name] = generatedUpstreamName
+		uc := upstreamConfigs[upstream.Name]
+		uc.Directives = buildUpstreamDirectives(&upstream, generatedUpstreamName)
+		uc.Servers = make([]upstreamServer, 0)
+		for _, server := range upstream.Servers {
+			addr, err := file_config.NormalizeUpstreamAddr(server.Addr)
+			if err != nil {
+				return "", nil, fmt.Errorf("upstream %s: %w", upstream.Name, err)
+			}
+			uc.Servers = append(uc.Servers, upstreamServer{
+				Addr:  addr,
+				Flags: server.Flags,
+			})
+		}
+
+		if upstream.App != "" {
+			listeners := data.UpstreamAppListeners[upstream.App]
+			if len(listeners) == 0 {
+				return "", nil, fmt.Errorf("upstream %s: app %s has no running web listeners", upstream.Name, upstream.App)
+			}
+			servers, err := listenerServers(listeners, strconv.Itoa(upstream.Port))
+			if err != nil {
+				return "", nil, fmt.Errorf("app %s: %w", upstream.App, err)
+			}
+			uc.Servers = append(uc.Servers, servers...)
+		}
+	}
+
+	for _, upstreamCfg := range config.Upstreams {
+		var ucs []*upstreamConfig
+		switch {
+		case upstreamCfg.SelectProcess != "":
+			ucs = append(ucs, upstreamConfigs[fmt.Sprintf("process-%s-%d", upstreamCfg.SelectProcess, upstreamCfg.SelectProcessPort)])
+		case upstreamCfg.SelectDefault && upstreamCfg.SelectDefaultPort != 0:
+			uc, ok := upstreamConfigs[fmt.Sprintf("default-%d", upstreamCfg.SelectDefaultPort)]
+			if !ok {
+				return "", nil, fmt.Errorf("failed to find upstream config for port %d", upstreamCfg.SelectDefaultPort)
+			}
+			ucs = append(ucs, uc)
+		case upstreamCfg.SelectDefault:
+			for _, port := range data.ProxyUpstreamPorts {
+				ucs = append(ucs, upstreamConfigs[fmt.Sprintf("default-%s", port)])
+			}
+		default:
+			continue
+		}
+
+		for _, uc := range ucs {
+			if directives := buildUpstreamDirectives(&upstreamCfg, uc.GeneratedUpstreamName); len(directives) > 0 {
+				uc.Directives = directives
+			}
+			if err := applyServersFlags(uc, upstreamCfg.DefaultServersFlags); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+
+	// upstreams are written in the order of their nginx names
+	sortedUpstreamConfigs := make([]*upstreamConfig, 0, len(upstreamConfigs))
+	for _, uc := range upstreamConfigs {
+		sortedUpstreamConfigs = append(sortedUpstreamConfigs, uc)
+	}
+	sort.SliceStable(sortedUpstreamConfigs, func(i, j int) bool {
+		return sortedUpstreamConfigs[i].GeneratedUpstreamName < sortedUpstreamConfigs[j].GeneratedUpstreamName
+	})
+
+	for _, uc := range sortedUpstreamConfigs {
+		for i, server := range uc.Servers {
+			flagsString, err := formatFlags(server.Flags, config.UserVars, "flag_string")
+			if err != nil {
+				return "", nil, err
+			}
+			uc.Servers[i].FlagsString = flagsString
+		}
+
+		if len(uc.Servers) == 0 {
+			data.warnings = append(data.warnings, fmt.Sprintf("upstream %s has no servers, requests to it will get a 502", uc.GeneratedUpstreamName))
+			uc.Placeholder = true
+			uc.Servers = []upstreamServer{placeholderUpstreamServer}
+		}
+	}
+
+	templateStr := `{{- range $value := $.upstreamConfigs -}}
+upstream {{ $value.GeneratedUpstreamName }} {
+{{- if $value.Placeholder }}
+  # no running servers, placeholder until the app is scaled up
+{{- end }}
+{{- range $directive := $value.Directives }}
+  {{ $directive }};
+{{- end }}
+{{- range $server := $value.Servers }}
+  server {{ $server.Addr }} {{- if $server.FlagsString }} {{ $server.FlagsString }}{{ end -}};
+{{- end }}
+}
+{{ end -}}`
+
+	dataRaw := map[string]any{
+		"upstreamConfigs": sortedUpstreamConfigs,
+		"vars":            config.UserVars,
+	}
+
+	result, err := sigil.Execute([]byte(templateStr), dataRaw, "upstream_config")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse template: %w", err)
+	}
+
+	return result.String(), upstreamResultingNames, nil
+}
+
+// formatFlags renders flag or flag=value entries sorted by flag name, so
+// the output does not depend on map iteration order. Each entry is a
+// template over the user vars.
+func formatFlags(flags map[string]string, userVars file_config.ConfigVars, templateName string) (string, error) {
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	formatted := make([]string, 0, len(names))
+	for _, name := range names {
+		flagString := name
+		if value := flags[name]; value != "" {
+			flagString = fmt.Sprintf("%s=%s", name, value)
+		}
+		flagStringTemplated, err := sigil.Execute([]byte(flagString), map[string]any{"vars": userVars}, templateName)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse template: %w", err)
+		}
+		formatted = append(formatted, flagStringTemplated.String())
+	}
+	return strings.Join(formatted, " "), nil
+}
+
+type mapConfig struct {
+	String   string `json:"string" yaml:"string"`
+	Variable string `json:"variable" yaml:"variable"`
+	Lines    string `json:"lines" yaml:"lines"`
+}
+
+type mapResultingVariables map[string]string
+
+func buildMapConfig(appName string, config *file_config.Config) (string, mapResultingVariables, error) {
+	mapConfigStr := ""
+
+	templateStr := `map {{ $.string }} ${{ $.variable }} {
+{{- range $line := $.lines }}
+  {{ $line }}
+{{- end }}
+}
+`
+
+	mapResultingVariables := make(mapResultingVariables, 0)
+
+	for _, mapVar := range config.Maps {
+		variableName := fmt.Sprintf("%s_%s", appName, mapVar.Variable)
+
+		linesOut, err := sigil.Execute([]byte(mapVar.Lines), map[string]any{"vars": config.UserVars}, "map_lines")
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to parse template: %w", err)
+		}
+
+		stringOut, err := sigil.Execute([]byte(mapVar.String), map[string]any{"vars": config.UserVars}, "map_string")
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to parse template: %w", err)
+		}
+
+		dataRaw := map[string]any{
+			"variable": variableName,
+			"string":   stringOut.String(),
+			"lines":    strings.Split(linesOut.String(), "\n"),
+		}
+
+		result, err := sigil.Execute([]byte(templateStr), dataRaw, "map_config")
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to parse template: %w", err)
+		}
+		mapConfigStr += result.String()
+
+		for _, mapVar := range config.Maps {
+			mapResultingVariables[mapVar.Variable] = variableName
+		}
+
+	}
+
+	return mapConfigStr, mapResultingVariables, nil
+}
+
+type buildProxyCacheConfigData struct {
+	proxyCacheOnDiskRootPath string
+	proxyCacheInMemRootPath  string
+	proxyCacheDefaultFlags   map[string]string
+	proxyCacheKeyZoneSize    string
+
+	fastcgiOnDiskRootPath string
+	fastcgiInMemRootPath  string
+	fastcgiDefaultFlags   map[string]string
+	fastcgiKeyZoneSize    string
+}
+
+type cacheResultingNames map[string]string
+
+func buildProxyCacheConfig(appName string, buildProxyCacheCfgData buildProxyCacheConfigData, config *file_config.Config) (string, cacheResultingNames, error) {
+	cacheResultingNames := make(cacheResultingNames, 0)
+
+	cfgStr := ""
+
+	for _, cache := range config.ProxyCaches {
+		cacheName := fmt.Sprintf("%s_%s", appName, cache.Name)
+		cachePath := cache.CachePath
+		if cachePath == "" {
+			if cache.InMem {
+				cachePath = path.Join(buildProxyCacheCfgData.proxyCacheInMemRootPath, cacheName)
+			} else {
+				cachePath = path.Join(buildProxyCacheCfgData.proxyCacheOnDiskRootPath, cacheName)
+			}
+		}
+
+		// Cloned, merging into the defaults would leak the flags of a cache
+		// into the next ones
+		flags := maps.Clone(buildProxyCacheCfgData.proxyCacheDefaultFlags)
+		if cache.Flags != nil {
+			mergo.Merge(&flags, cache.Flags, mergo.WithOverride)
+		}
+
+		keyZoneSize := cache.KeyZoneSize
+		if keyZoneSize == "" {
+			keyZoneSize = buildProxyCacheCfgData.proxyCacheKeyZoneSize
+		}
+
+		cacheResultingNames[cache.Name] = cacheName
+
+		flagStr, err := formatFlags(flags, config.UserVars, "proxy_cache_flag_string")
+		if err != nil {
+			return "", nil, err
+		}
+
+		if cfgStr != "" {
+			cfgStr += "\n"
+		}
+
+		cfgStr += fmt.Sprintf("proxy_cache_path %s keys_zone=%s:%s %s;", cachePath, cacheName, keyZoneSize, flagStr)
+	}
+
+	return cfgStr, cacheResultingNames, nil
+}
+
+func buildFastcgiCacheConfig(appName string, buildProxyCacheCfgData buildProxyCacheConfigData, config *file_config.Config) (string, cacheResultingNames, error) {
+	cacheResultingNames := make(cacheResultingNames, 0)
+
+	cfgStr := ""
+
+	for _, cache := range config.FastcgiCaches {
+		cacheName := fmt.Sprintf("%s_%s", appName, cache.Name)
+		cachePath := cache.CachePath
+		if cachePath == "" {
+			if cache.InMem {
+				cachePath = path.Join(buildProxyCacheCfgData.fastcgiInMemRootPath, cacheName)
+			} else {
+				cachePath = path.Join(buildProxyCacheCfgData.fastcgiOnDiskRootPath, cacheName)
+			}
+		}
+
+		flags := maps.Clone(buildProxyCacheCfgData.fastcgiDefaultFlags)
+		if cache.Flags != nil {
+			mergo.Merge(&flags, cache.Flags, mergo.WithOverride)
+		}
+
+		keyZoneSize := cache.KeyZoneSize
+		if keyZoneSize == "" {
+			keyZoneSize = buildProxyCacheCfgData.fastcgiKeyZoneSize
+		}
+
+		cacheResultingNames[cache.Name] = cacheName
+
+		flagStr, err := formatFlags(flags, config.UserVars, "fastcgi_cache_flag_string")
+		if err != nil {
+			return "", nil, err
+		}
+
+		if cfgStr != "" {
+			cfgStr += "\n"
+		}
+		cfgStr += fmt.Sprintf("fastcgi_cache_path %s keys_zone=%s:%s %s;", cachePath, cacheName, keyZoneSize, flagStr)
+	}
+
+	return cfgStr, cacheResultingNames, nil
+}
+
+type locationConfigData struct {
+	upstreams     upstreamResultingNames
+	mapVariables  mapResultingVariables
+	proxyCaches   cacheResultingNames
+	fastcgiCaches cacheResultingNames
+}
+
+type vhostToLocationConfigStringMap map[string]string
+
+// buildBodyTemplateData returns the data shared by every user-supplied
+// template body: resolved upstream, map variable and cache names plus the
+// user vars.
+func buildBodyTemplateData(config *file_config.Config, data *locationConfigData) map[string]any {
+	return map[string]any{
+		"map_variables":  data.mapVariables,
+		"upstreams":      data.upstreams,
+		"proxy_caches":   data.proxyCaches,
+		"fastcgi_caches": data.fastcgiCaches,
+		"vars":           config.UserVars,
+	}
+}
+
+// buildVhostBodyTemplateData extends buildBodyTemplateData with the vhost
+// scoped variables and named locations.
+func buildVhostBodyTemplateData(appName string, vhost *file_config.VhostConfig, config *file_config.Config, data *locationConfigData) map[string]any {
+	variableNames := make(map[string]string)
+	for _, variable := range vhost.Variables {
+		variableNames[variable.Name] = variable.Name
+	}
+
+	namedLocations := make(map[string]string)
+	for _, location := range vhost.Locations {
+		if location.Named != "" {
+			namedLocations[location.Named] = fmt.Sprintf("%s_%s", appName, location.Named)
+		}
+	}
+
+	bodyTmplData := buildBodyTemplateData(config, data)
+	bodyTmplData["variables"] = variableNames
+	bodyTmplData["named_locations"] = namedLocations
+	return bodyTmplData
+}
+
+func buildLocationConfig(appName string, config *file_config.Config, data *locationConfigData) (vhostToLocationConfigStringMap, error) {
+	locationConfigs := make(vhostToLocationConfigStringMap, 0)
+
+	tmplLocationBlockStr := `location {{ $.modifier }} {{ if $.named }}@{{ $.named }}{{ else }}{{ $.uri }}{{ end }} {
+{{- range $line := $.bodyLines }}
+  {{ $line -}}
+{{- end }}
+}
+`
+
+	for _, vhost := range config.Vhosts {
+		locationConfigStr := ""
+
+		tmplData := map[string]any{
+			"locationConfigs": make(map[string]any),
+			"vars":            config.UserVars,
+		}
+
+		bodyTmplData := buildVhostBodyTemplateData(appName, &vhost, config, data)
+		namedLocations := bodyTmplData["named_locations"].(map[string]string)
+
+		for _, location := range vhost.Locations {
+			if location.Include != "" {
+				continue
+			}
+
+			modifierOut, err := sigil.Execute([]byte(location.Modifier), bodyTmplData, fmt.Sprintf("location_modifier_vhost_%s_uri_%s", vhost.ServerName, location.Uri))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse template: %w", err)
+			}
+			tmplData["modifier"] = modifierOut.String()
+
+			uriOut, err := sigil.Execute([]byte(location.Uri), bodyTmplData, fmt.Sprintf("location_uri_vhost_%s_uri_%s", vhost.ServerName, location.Uri))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse template: %w", err)
+			}
+			tmplData["uri"] = uriOut.String()
+
+			bodyOut, err := sigil.Execute([]byte(location.Body), bodyTmplData, fmt.Sprintf("location_body_vhost_%s_uri_%s", vhost.ServerName, location.Uri))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse template: %w", err)
+			}
+			bodyLines := strings.Split(bodyOut.String(), "\n")
+			tmplData["bodyLines"] = bodyLines
+
+			if location.Named != "" {
+				tmplData["named"] = namedLocations[location.Named]
+			} else {
+				tmplData["named"] = ""
+			}
+
+			locationOut, err := sigil.Execute([]byte(tmplLocationBlockStr), tmplData, fmt.Sprintf("location_block_vhost_%s_uri_%s", vhost.ServerName, location.Uri))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse template: %w", err)
+			}
+
+			if locationConfigStr != "" {
+				locationConfigStr += "\n"
+			}
+			locationConfigStr += locationOut.String()
+
+		}
+
+		locationConfigs[vhost.ServerName] = locationConfigStr
+	}
+
+	return locationConfigs, nil
+}
+
+type vhostToServerConfigStringMap map[string]string
+
+// buildInHttpBlockConfig renders the top-level in_http_block with the same
+// data location bodies get, minus the vhost scoped keys.
+func buildInHttpBlockConfig(config *file_config.Config, data *locationConfigData) (string, error) {
+	if config.InHttpBlock == "" {
+		return "", nil
+	}
+
+	out, err := sigil.Execute([]byte(config.InHttpBlock), buildBodyTemplateData(config, data), "in_http_block")
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template: %w", err)
+	}
+
+	return out.String(), nil
+}
+
+// buildInServerBlockConfig renders each vhost's in_server_block with the same
+// data its location bodies get.
+func buildInServerBlockConfig(appName string, config *file_config.Config, data *locationConfigData) (vhostToServerConfigStringMap, error) {
+	serverConfigs := make(vhostToServerConfigStringMap, 0)
+
+	for _, vhost := range config.Vhosts {
+		if vhost.InServerBlock == "" {
+			serverConfigs[vhost.ServerName] = ""
+			continue
+		}
+
+		bodyTmplData := buildVhostBodyTemplateData(appName, &vhost, config, data)
+		out, err := sigil.Execute([]byte(vhost.InServerBlock), bodyTmplData, fmt.Sprintf("in_server_block_vhost_%s", vhost.ServerName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse template: %w", err)
+		}
+
+		serverConfigs[vhost.ServerName] = out.String()
+	}
+
+	return serverConfigs, nil
+}
+
+// PortMapping is a scheme:listen:upstream entry of the app's port map
+type PortMapping struct {
+	Scheme       string `json:"scheme"`
+	ListenPort   string `json:"listenPort"`
+	UpstreamPort string `json:"upstreamPort"`
+}
+
+// ParsePortMap parses the space-separated scheme:listen:upstream entries
+// of PROXY_PORT_MAP.
+func ParsePortMap(portMap string) ([]PortMapping, error) {
+	mappings := make([]PortMapping, 0)
+	for _, entry := range strings.Fields(portMap) {
+		entrySplit := strings.Split(entry, ":")
+		if len(entrySplit) != 3 {
+			return nil, fmt.Errorf("failed to parse port map %s", entry)
+		}
+		mappings = append(mappings, PortMapping{
+			Scheme:       entrySplit[0],
+			ListenPort:   entrySplit[1],
+			UpstreamPort: entrySplit[2],
+		})
+	}
+	return mappings, nil
+}
+
+type serverBlockConfigData struct {
+	portMappings []PortMapping
+	// sslPath is the directory holding the app's server.crt and server.key,
+	// empty when the app has no certs
+	sslPath string
+	// errorPagesDirectory holds the plugin's error pages, none are served
+	// when empty
+	errorPagesDirectory string
+
+	// warnings collects the problems that do not fail the build
+	warnings []string
+}
+
+type vhostToServerBlockConfigStringMap map[string]string
+
+// errorPagesConfig serves the plugin's 502 error page, which requests to the
+// placeholder upstream of an app without running containers get. Empty when
+// errorPagesDirectory is.
+func errorPagesConfig(errorPagesDirectory string) string {
+	if errorPagesDirectory == "" {
+		return ""
+	}
+	return fmt.Sprintf("error_page 502 /502-error.html;\nlocation = /502-error.html {\n  root %s;\n  internal;\n}\n", errorPagesDirectory)
+}
+
+// existingServerConfig is the server.conf of an existing vhost: its
+// in_server_block followed by the error pages, which the server block
+// managed elsewhere would not serve otherwise.
+func existingServerConfig(serverConfig string, errorPagesDirectory string) string {
+	errorPages := errorPagesConfig(errorPagesDirectory)
+	if errorPages == "" {
+		return serverConfig
+	}
+	if serverConfig != "" {
+		serverConfig = strings.TrimRight(serverConfig, "\n") + "\n\n"
+	}
+	return serverConfig + errorPages
+}
+
+// indentLines indents every non-empty line of s with prefix.
+func indentLines(s string, prefix string) []string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(strings.TrimRight(s, "\n"), "\n") {
+		if strings.TrimSpace(line) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		lines = append(lines, prefix+line)
+	}
+	return lines
+}
+
+// buildServerBlockConfig wraps the in_server_block and location configs of
+// every vhost the plugin owns (existing: false) into a complete server block.
+// Existing vhosts are skipped, their fragments are included by whoever
+// manages their server block.
+func buildServerBlockConfig(config *file_config.Config, locationConfigs vhostToLocationConfigStringMap, serverConfigs vhostToServerConfigStringMap, data *serverBlockConfigData) (vhostToServerBlockConfigStringMap, error) {
+	serverBlockConfigs := make(vhostToServerBlockConfigStringMap, 0)
+
+	templateStr := `server {
+{{- range $listen := $.listens }}
+  listen {{ $listen }};
+{{- end }}
+  server_name {{ $.serverName }};
+{{- if $.sslPath }}
+
+  ssl_certificate {{ $.sslPath }}/server.crt;
+  ssl_certificate_key {{ $.sslPath }}/server.key;
+{{- end }}
+{{- if $.serverLines }}
+{{ range $line := $.serverLines }}
+{{ $line }}
+{{- end }}
+{{- end }}
+{{- if $.locationLines }}
+{{ range $line := $.locationLines }}
+{{ $line }}
+{{- end }}
+{{- end }}
+{{- if $.errorPageLines }}
+{{ range $line := $.errorPageLines }}
+{{ $line }}
+{{- end }}
+{{- end }}
+}
+`
+
+	for _, vhost := range config.Vhosts {
+		if vhost.Existing {
+			continue
+		}
+
+		listens := make([]string, 0)
+		seen := make(map[string]bool)
+		sslPath := ""
+		for _, mapping := range data.portMappings {
+			var flags string
+			switch mapping.Scheme {
+			case "http":
+			case "grpc":
+				// nginx only takes gRPC over http2
+				flags = " http2"
+			case "https", "grpcs":
+				if data.sslPath == "" {
+					data.warnings = append(data.warnings, fmt.Sprintf("skipping %s:%s for vhost %s: app has no ssl certificate", mapping.Scheme, mapping.ListenPort, vhost.ServerName))
+					continue
+				}
+				flags = " ssl"
+				if mapping.Scheme == "grpcs" {
+					flags += " http2"
+				}
+				sslPath = data.sslPath
+			default:
+				continue
+			}
+
+			if seen[mapping.ListenPort] {
+				continue
+			}
+			seen[mapping.ListenPort] = true
+			listens = append(listens, mapping.ListenPort+flags, fmt.Sprintf("[::]:%s%s", mapping.ListenPort, flags))
+		}
+
+		if len(listens) == 0 {
+			return nil, fmt.Errorf("no http or https port mapping to listen on for vhost %s", vhost.ServerName)
+		}
+
+		dataRaw := map[string]any{
+			"listens":        listens,
+			"serverName":     vhost.ServerName,
+			"sslPath":        sslPath,
+			"serverLines":    []string{},
+			"locationLines":  []string{},
+			"errorPageLines": []string{},
+		}
+		if errorPages := errorPagesConfig(data.errorPagesDirectory); errorPages != "" {
+			dataRaw["errorPageLines"] = indentLines(errorPages, "  ")
+		}
+		if serverConfigs[vhost.ServerName] != "" {
+			dataRaw["serverLines"] = indentLines(serverConfigs[vhost.ServerName], "  ")
+		}
+		if locationConfigs[vhost.ServerName] != "" {
+			dataRaw["locationLines"] = indentLines(locationConfigs[vhost.ServerName], "  ")
+		}
+
+		result, err := sigil.Execute([]byte(templateStr), dataRaw, fmt.Sprintf("server_block_vhost_%s", vhost.ServerName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse template: %w", err)
+		}
+
+		serverBlockConfigs[vhost.ServerName] = result.String()
+	}
+
+	return serverBlockConfigs, nil
+}
+
+func getPreviousVersionDirectory(nginxConfigDirectory string) (string, error) {
+	currentSymlink := path.Join(nginxConfigDirectory, "current")
+
+	// Check if current symlink exists
+	if _, err := os.Lstat(currentSymlink); os.IsNotExist(err) {
+		return "", nil // No previous version
+	}
+
+	// Resolve the symlink
+	previousDir, err := os.Readlink(currentSymlink)
+	if err != nil {
+		return "", fmt.Errorf("failed to read current symlink: %w", err)
+	}
+
+	// Make it absolute if it's relative
+	if !path.IsAbs(previousDir) {
+		previousDir = path.Join(nginxConfigDirectory, previousDir)
+	}
+
+	return previousDir, nil
+}
+
+func copyConfigToRelease(configContent string, releaseDir string, filename string) error {
+	configPath := path.Join(releaseDir, filename)
+
+	// Create the full directory path including any subdirectories
+	configDir := path.Dir(configPath)
+	if err := os.MkdirAll(configDir, 0755); err != nil {
+		return fmt.Errorf("failed to create config directory %s: %w", configDir, err)
+	}
+
+	// Write the config content to the file
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		return fmt.Errorf("failed to write config file %s: %w", filename, err)
+	}
+
+	return nil
+}
+
+// updateCurrentSymlink points current at newReleaseDir. The new link is
+// created under a temporary name and renamed over current, rename(2) being
+// atomic, so current never goes missing for nginx or a crashed build.
+func updateCurrentSymlink(nginxConfigDirectory string, newReleaseDir string) error {
+	currentSymlink := path.Join(nginxConfigDirectory, "current")
+	tempSymlink := path.Join(nginxConfigDirectory, fmt.Sprintf(".current.%d.tmp", os.Getpid()))
+
+	// Use relative path for the symlink
+	relPath, err := filepath.Rel(nginxConfigDirectory, newReleaseDir)
+	if err != nil {
+		return fmt.Errorf("failed to get relative path: %w", err)
+	}
+
+	// Left over by a build of a crashed process with the same pid
+	if err := os.Remove(tempSymlink); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale temporary symlink: %w", err)
+	}
+
+	if err := os.Symlink(relPath, tempSymlink); err != nil {
+		return fmt.Errorf("failed to create temporary symlink: %w", err)
+	}
+
+	if err := os.Rename(tempSymlink, currentSymlink); err != nil {
+		os.Remove(tempSymlink)
+		return fmt.Errorf("failed to swap current symlink: %w", err)
+	}
+
+	return nil
+}
+
+func testNginxConfig(ctx context.Context, nginxTestCommand string) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", nginxTestCommand)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nginx config test failed: %s", string(output))
+	}
+	return nil
+}
+
+// emptyReleaseName is the directory current points at after the first
+// release of an app failed: it holds no config, like before that build, but
+// keeps current from going missing.
+const emptyReleaseName = "empty"
+
+func rollbackToPrevious(nginxConfigDirectory string, previousDir string) error {
+	if previousDir == "" {
+		// No previous version to rollback to, current points at an empty
+		// release instead of being removed
+		previousDir = path.Join(nginxConfigDirectory, emptyReleaseName)
+		if err := os.MkdirAll(previousDir, 0755); err != nil {
+			return fmt.Errorf("failed to create empty release during rollback: %w", err)
+		}
+	}
+
+	// Rollback to previous version, swapping current atomically
+	return updateCurrentSymlink(nginxConfigDirectory, previousDir)
+}
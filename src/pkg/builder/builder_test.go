@@ -0,0 +1,1119 @@
+package builder
+
+import (
+	"dokku-nginx-custom/src/pkg/file_config"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/sigil"
+)
+
+// buildTime is the time of the builds in the release directory tests
+var buildTime = time.Date(2001, 12, 25, 10, 0, 0, 0, time.UTC)
+
+func TestGetNextReleaseDirectory(t *testing.T) {
+	// Test case 1: Directory with multiple release directories
+	t.Run("MultipleReleaseDirectories", func(t *testing.T) {
+		tempDir := t.TempDir()
+
+		// Create test release directories with date/sequence format
+		releaseDirs := []string{
+			"release-20011225.1", // 2001/12/25, sequence 1
+			"release-20011225.2", // 2001/12/25, sequence 2
+			"release-20011225.3", // 2001/12/25, sequence 3 (latest)
+		}
+
+		for _, dir := range releaseDirs {
+			err := os.MkdirAll(filepath.Join(tempDir, dir), 0755)
+			if err != nil {
+				t.Fatalf("Failed to create test directory %s: %v", dir, err)
+			}
+		}
+
+		// Create a non-release directory to ensure it's ignored
+		err := os.MkdirAll(filepath.Join(tempDir, "not-a-release"), 0755)
+		if err != nil {
+			t.Fatalf("Failed to create non-release directory: %v", err)
+		}
+
+		// Test the function
+		result, err := getNextReleaseDirectory(tempDir, buildTime)
+
+		if err != nil {
+			t.Errorf("Expected no error, got: %v", err)
+		}
+
+		// Should continue after the latest sequence of the day
+		expected := filepath.Join(tempDir, "release-20011225.4")
+		if result != expected {
+			t.Errorf("Expected %s, got: %s", expected, result)
+		}
+	})
+
+	// Test case 2: Directory with no release directories
+	t.Run("NoReleaseDirectories", func(t *testing.T) {
+		emptyDir := t.TempDir()
+
+		result, err := getNextReleaseDirectory(emptyDir, buildTime)
+
+		if err != nil {
+			t.Errorf("Expected no error for empty directory, got: %v", err)
+		}
+
+		// Should return the first release of the build date
+		expectedPath := filepath.Join(emptyDir, "release-20011225.1")
+		if result != expectedPath {
+			t.Errorf("Expected %s, got: %s", expectedPath, result)
+		}
+	})
+
+	// Test case 3: Non-existent directory
+	t.Run("NonExistentDirectory", func(t *testing.T) {
+		tempDir := t.TempDir()
+		nonExistentDir := filepath.Join(tempDir, "does-not-exist")
+
+		result, err := getNextReleaseDirectory(nonExistentDir, buildTime)
+
+		// The function should return a new release directory path even for non-existent directories
+		if err != nil {
+			t.Errorf("Expected no error for non-existent directory, got: %v", err)
+		}
+
+		expectedPath := filepath.Join(nonExistentDir, "release-20011225.1")
+		if result != expectedPath {
+			t.Errorf("Expected %s, got: %s", expectedPath, result)
+		}
+	})
+
+	// Test case 4: Directory with mixed files and directories
+	t.Run("MixedFilesAndDirectories", func(t *testing.T) {
+		mixedDir := t.TempDir()
+
+		// Create release directories with proper format
+		releaseDirs := []string{
+			"release-20011225.1",
+			"release-20011225.2",
+		}
+
+		for _, dir := range releaseDirs {
+			err := os.MkdirAll(filepath.Join(mixedDir, dir), 0755)
+			if err != nil {
+				t.Fatalf("Failed to create test directory %s: %v", dir, err)
+			}
+		}
+
+		// Create some files that should be ignored
+		files := []string{
+			"config.conf",
+			"release-file.txt",   // This should be ignored (not a directory)
+			"release-20011225.7", // This should be ignored (not a directory)
+		}
+
+		for _, file := range files {
+			err := os.WriteFile(filepath.Join(mixedDir, file), []byte("test"), 0644)
+			if err != nil {
+				t.Fatalf("Failed to create test file %s: %v", file, err)
+			}
+		}
+
+		result, err := getNextReleaseDirectory(mixedDir, buildTime)
+
+		if err != nil {
+			t.Errorf("Expected no error, got: %v", err)
+		}
+
+		expected := filepath.Join(mixedDir, "release-20011225.3")
+		if result != expected {
+			t.Errorf("Expected %s, got: %s", expected, result)
+		}
+	})
+
+	// Test case 5: Test date comparison (different dates)
+	t.Run("DifferentDates", func(t *testing.T) {
+		dateDir := t.TempDir()
+
+		// Create release directories with different dates
+		releaseDirs := []string{
+			"release-20011224.5",  // 2001/12/24, sequence 5
+			"release-20011225.1",  // 2001/12/25, sequence 1 (build date)
+			"release-20011223.10", // 2001/12/23, sequence 10
+		}
+
+		for _, dir := range releaseDirs {
+			err := os.MkdirAll(filepath.Join(dateDir, dir), 0755)
+			if err != nil {
+				t.Fatalf("Failed to create test directory %s: %v", dir, err)
+			}
+		}
+
+		result, err := getNextReleaseDirectory(dateDir, buildTime)
+
+		if err != nil {
+			t.Errorf("Expected no error, got: %v", err)
+		}
+
+		// Only the build date's sequence counts
+		expected := filepath.Join(dateDir, "release-20011225.2")
+		if result != expected {
+			t.Errorf("Expected %s, got: %s", expected, result)
+		}
+	})
+
+	// Test case 6: The sequence starts over on a new day
+	t.Run("NewDayResetsSequence", func(t *testing.T) {
+		dateDir := t.TempDir()
+
+		if err := os.MkdirAll(filepath.Join(dateDir, "release-20011224.5"), 0755); err != nil {
+			t.Fatalf("Failed to create test directory: %v", err)
+		}
+
+		result, err := getNextReleaseDirectory(dateDir, buildTime)
+
+		if err != nil {
+			t.Errorf("Expected no error, got: %v", err)
+		}
+
+		expected := filepath.Join(dateDir, "release-20011225.1")
+		if result != expected {
+			t.Errorf("Expected %s, got: %s", expected, result)
+		}
+	})
+
+	// Test case 7: Test invalid format directories (should be ignored)
+	t.Run("InvalidFormatDirectories", func(t *testing.T) {
+		invalidDir := t.TempDir()
+
+		// Create directories with invalid formats
+		invalidDirs := []string{
+			"release-1.0.0",         // Wrong format
+			"release-2.0.0-beta",    // Wrong format
+			"release-3.0.0-alpha.1", // Wrong format
+			"release-20011225",      // Missing sequence
+			"release-20011225.",     // Missing sequence number
+		}
+
+		for _, dir := range invalidDirs {
+			err := os.MkdirAll(filepath.Join(invalidDir, dir), 0755)
+			if err != nil {
+				t.Fatalf("Failed to create test directory %s: %v", dir, err)
+			}
+		}
+
+		result, err := getNextReleaseDirectory(invalidDir, buildTime)
+
+		if err != nil {
+			t.Errorf("Expected no error, got: %v", err)
+		}
+
+		expected := filepath.Join(invalidDir, "release-20011225.1")
+		if result != expected {
+			t.Errorf("Expected %s, got: %s", expected, result)
+		}
+	})
+}
+
+// TestListReleases tests complex scenarios
+func TestListReleases(t *testing.T) {
+	// Test case: Complex scenario with multiple dates and sequences
+	t.Run("ComplexScenario", func(t *testing.T) {
+		tempDir := t.TempDir()
+
+		// Create test release directories with various dates and sequences
+		releaseDirs := []string{
+			"release-20011224.1",  // 24/12/01, sequence 1
+			"release-20011224.3",  // 24/12/01, sequence 3
+			"release-20011225.1",  // 25/12/01, sequence 1 (latest date)
+			"release-20011225.2",  // 25/12/01, sequence 2 (latest overall)
+			"release-20011223.10", // 23/12/01, sequence 10 (older date)
+		}
+
+		for _, dir := range releaseDirs {
+			err := os.MkdirAll(filepath.Join(tempDir, dir), 0755)
+			if err != nil {
+				t.Fatalf("Failed to create test directory %s: %v", dir, err)
+			}
+		}
+
+		releases, err := listReleases(tempDir)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		// Should be ordered oldest first, by date then sequence
+		expectedOrder := []string{
+			"release-20011223.10",
+			"release-20011224.1",
+			"release-20011224.3",
+			"release-20011225.1",
+			"release-20011225.2",
+		}
+		if len(releases) != len(expectedOrder) {
+			t.Fatalf("Expected %d releases, got: %d", len(expectedOrder), len(releases))
+		}
+		for i, expected := range expectedOrder {
+			if filepath.Base(releases[i].Dir) != expected {
+				t.Errorf("Expected release #%d to be %s, got: %s", i, expected, releases[i].Dir)
+			}
+		}
+
+		result, err := getNextReleaseDirectory(tempDir, buildTime)
+		if err != nil {
+			t.Errorf("Expected no error, got: %v", err)
+		}
+
+		expected := filepath.Join(tempDir, "release-20011225.3")
+		if result != expected {
+			t.Errorf("Expected %s, got: %s", expected, result)
+		}
+
+		// Verify that the directories exist
+		for _, dir := range releaseDirs {
+			fullPath := filepath.Join(tempDir, dir)
+			if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+				t.Errorf("Expected directory %s to exist", fullPath)
+			}
+		}
+	})
+}
+
+// TestDeploymentFunctions tests the deployment-related functions
+func TestDeploymentFunctions(t *testing.T) {
+	// Test getPreviousVersionDirectory
+	t.Run("GetPreviousVersionDirectory", func(t *testing.T) {
+		tempDir := t.TempDir()
+
+		// Test case 1: No current symlink exists
+		prevDir, err := getPreviousVersionDirectory(tempDir)
+		if err != nil {
+			t.Errorf("Expected no error, got: %v", err)
+		}
+		if prevDir != "" {
+			t.Errorf("Expected empty string, got: %s", prevDir)
+		}
+
+		// Test case 2: Create a current symlink
+		releaseDir := filepath.Join(tempDir, "release-20011225.1")
+		if err := os.MkdirAll(releaseDir, 0755); err != nil {
+			t.Fatalf("Failed to create release directory: %v", err)
+		}
+
+		currentSymlink := filepath.Join(tempDir, "current")
+		if err := os.Symlink("release-20011225.1", currentSymlink); err != nil {
+			t.Fatalf("Failed to create symlink: %v", err)
+		}
+
+		prevDir, err = getPreviousVersionDirectory(tempDir)
+		if err != nil {
+			t.Errorf("Expected no error, got: %v", err)
+		}
+		expected := filepath.Join(tempDir, "release-20011225.1")
+		if prevDir != expected {
+			t.Errorf("Expected %s, got: %s", expected, prevDir)
+		}
+	})
+
+	// Test copyConfigToRelease
+	t.Run("CopyConfigToRelease", func(t *testing.T) {
+		tempDir := t.TempDir()
+		releaseDir := filepath.Join(tempDir, "release-20011225.1")
+		configContent := "test config content"
+		filename := "test.conf"
+
+		err := copyConfigToRelease(configContent, releaseDir, filename)
+		if err != nil {
+			t.Errorf("Expected no error, got: %v", err)
+		}
+
+		// Verify the file was created
+		configPath := filepath.Join(releaseDir, filename)
+		if _, err := os.Stat(configPath); os.IsNotExist(err) {
+			t.Errorf("Expected config file to exist at %s", configPath)
+		}
+
+		// Verify the content
+		content, err := os.ReadFile(configPath)
+		if err != nil {
+			t.Errorf("Failed to read config file: %v", err)
+		}
+		if string(content) != configContent {
+			t.Errorf("Expected content %s, got: %s", configContent, string(content))
+		}
+	})
+
+	// Test copyConfigToRelease with nested directories
+	t.Run("CopyConfigToReleaseWithNestedDirs", func(t *testing.T) {
+		tempDir := t.TempDir()
+		releaseDir := filepath.Join(tempDir, "release-20011225.1")
+		configContent := "vhost config content"
+		filename := "vhosts/example.com/vhost.conf"
+
+		err := copyConfigToRelease(configContent, releaseDir, filename)
+		if err != nil {
+			t.Errorf("Expected no error, got: %v", err)
+		}
+
+		// Verify the nested directory was created
+		vhostDir := filepath.Join(releaseDir, "vhosts", "example.com")
+		if _, err := os.Stat(vhostDir); os.IsNotExist(err) {
+			t.Errorf("Expected vhost directory to exist at %s", vhostDir)
+		}
+
+		// Verify the file was created
+		configPath := filepath.Join(releaseDir, filename)
+		if _, err := os.Stat(configPath); os.IsNotExist(err) {
+			t.Errorf("Expected config file to exist at %s", configPath)
+		}
+
+		// Verify the content
+		content, err := os.ReadFile(configPath)
+		if err != nil {
+			t.Errorf("Failed to read config file: %v", err)
+		}
+		if string(content) != configContent {
+			t.Errorf("Expected content %s, got: %s", configContent, string(content))
+		}
+	})
+
+	// Test updateCurrentSymlink
+	t.Run("UpdateCurrentSymlink", func(t *testing.T) {
+		tempDir := t.TempDir()
+		releaseDir := filepath.Join(tempDir, "release-20011225.1")
+
+		// Create the release directory
+		if err := os.MkdirAll(releaseDir, 0755); err != nil {
+			t.Fatalf("Failed to create release directory: %v", err)
+		}
+
+		err := updateCurrentSymlink(tempDir, releaseDir)
+		if err != nil {
+			t.Errorf("Expected no error, got: %v", err)
+		}
+
+		// Verify the symlink was created
+		currentSymlink := filepath.Join(tempDir, "current")
+		if _, err := os.Lstat(currentSymlink); os.IsNotExist(err) {
+			t.Errorf("Expected current symlink to exist")
+		}
+
+		// Verify the symlink points to the correct directory
+		target, err := os.Readlink(currentSymlink)
+		if err != nil {
+			t.Errorf("Failed to read symlink: %v", err)
+		}
+		expected := "release-20011225.1"
+		if target != expected {
+			t.Errorf("Expected symlink to point to %s, got: %s", expected, target)
+		}
+	})
+
+	// Test updateCurrentSymlink over an existing symlink
+	t.Run("UpdateCurrentSymlinkReplacesExisting", func(t *testing.T) {
+		tempDir := t.TempDir()
+		for _, dir := range []string{"release-20011225.1", "release-20011225.2"} {
+			if err := os.MkdirAll(filepath.Join(tempDir, dir), 0755); err != nil {
+				t.Fatalf("Failed to create release directory: %v", err)
+			}
+		}
+		if err := os.Symlink("release-20011225.1", filepath.Join(tempDir, "current")); err != nil {
+			t.Fatalf("Failed to create symlink: %v", err)
+		}
+
+		if err := updateCurrentSymlink(tempDir, filepath.Join(tempDir, "release-20011225.2")); err != nil {
+			t.Errorf("Expected no error, got: %v", err)
+		}
+
+		target, err := os.Readlink(filepath.Join(tempDir, "current"))
+		if err != nil {
+			t.Errorf("Failed to read symlink: %v", err)
+		}
+		if target != "release-20011225.2" {
+			t.Errorf("Expected symlink to point to release-20011225.2, got: %s", target)
+		}
+
+		// The temporary symlink is renamed, nothing is left behind
+		leftovers, err := filepath.Glob(filepath.Join(tempDir, ".current.*"))
+		if err != nil {
+			t.Fatalf("Failed to glob: %v", err)
+		}
+		if len(leftovers) != 0 {
+			t.Errorf("Expected no temporary symlinks, got: %v", leftovers)
+		}
+	})
+}
+
+// TestGetNextReleaseDirectoryNewRelease tests the behavior when no releases exist
+func TestGetNextReleaseDirectoryNewRelease(t *testing.T) {
+	t.Run("CreatesNewReleaseWhenNoneExist", func(t *testing.T) {
+		tempDir := t.TempDir()
+
+		result, err := getNextReleaseDirectory(tempDir, time.Now())
+
+		if err != nil {
+			t.Errorf("Expected no error, got: %v", err)
+		}
+
+		// Should return a new release directory path with today's date
+		expectedDate := time.Now().Format("20060102")
+		expectedPath := filepath.Join(tempDir, fmt.Sprintf("release-%s.1", expectedDate))
+		if result != expectedPath {
+			t.Errorf("Expected %s, got: %s", expectedPath, result)
+		}
+
+		// Verify the directory doesn't exist yet (it's just the path, not created)
+		if _, err := os.Stat(result); !os.IsNotExist(err) {
+			t.Errorf("Expected directory %s to not exist yet, but it does", result)
+		}
+	})
+
+	t.Run("CreatesNewReleaseForNonExistentPath", func(t *testing.T) {
+		tempDir := t.TempDir()
+		nonExistentDir := filepath.Join(tempDir, "does-not-exist")
+
+		result, err := getNextReleaseDirectory(nonExistentDir, time.Now())
+
+		if err != nil {
+			t.Errorf("Expected no error, got: %v", err)
+		}
+
+		// Should return a new release directory path with today's date
+		expectedDate := time.Now().Format("20060102")
+		expectedPath := filepath.Join(nonExistentDir, fmt.Sprintf("release-%s.1", expectedDate))
+		if result != expectedPath {
+			t.Errorf("Expected %s, got: %s", expectedPath, result)
+		}
+
+		// Verify the parent directory doesn't exist yet
+		if _, err := os.Stat(nonExistentDir); !os.IsNotExist(err) {
+			t.Errorf("Expected parent directory %s to not exist yet, but it does", nonExistentDir)
+		}
+	})
+}
+
+// validateWithHarness writes content into a temp file, wraps it with
+// templates/validate.conf.sigil for the given CONFIG_TYPE and runs nginx -t
+// on the result when an nginx binary is available.
+func validateWithHarness(t *testing.T, configType string, content string) string {
+	t.Helper()
+
+	tempDir := t.TempDir()
+	confPath := filepath.Join(tempDir, "snippet.conf")
+	if err := os.WriteFile(confPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write snippet: %v", err)
+	}
+
+	harnessTmpl, err := os.ReadFile("../../../templates/validate.conf.sigil")
+	if err != nil {
+		t.Fatalf("Failed to read validate harness: %v", err)
+	}
+
+	harness, err := sigil.Execute(harnessTmpl, map[string]any{
+		"CONFIG_TYPE": configType,
+		"NGINX_CONF":  confPath,
+	}, "validate_conf")
+	if err != nil {
+		t.Fatalf("Failed to render validate harness: %v", err)
+	}
+
+	if !strings.Contains(harness.String(), fmt.Sprintf("include %s;", confPath)) {
+		t.Fatalf("Expected harness to include %s, got:\n%s", confPath, harness.String())
+	}
+
+	harnessPath := filepath.Join(tempDir, "validate.conf")
+	if err := os.WriteFile(harnessPath, harness.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write validate harness: %v", err)
+	}
+
+	nginxBin, err := exec.LookPath("nginx")
+	if err != nil {
+		t.Skip("nginx not found in PATH, skipping nginx -t")
+	}
+
+	output, err := exec.Command(nginxBin, "-t", "-q", "-p", tempDir, "-c", harnessPath).CombinedOutput()
+	if err != nil {
+		t.Errorf("nginx -t failed for %s:\n%s", configType, string(output))
+	}
+
+	return harness.String()
+}
+
+func testLocationConfigData() *locationConfigData {
+	return &locationConfigData{
+		upstreams:     upstreamResultingNames{"default": "app-5000"},
+		mapVariables:  mapResultingVariables{"region": "app_region"},
+		proxyCaches:   cacheResultingNames{"in_mem": "app_in_mem"},
+		fastcgiCaches: cacheResultingNames{},
+	}
+}
+
+func TestBuildInHttpBlockConfig(t *testing.T) {
+	cfg := &file_config.Config{
+		UserVars: file_config.ConfigVars{"rate": "10r/s"},
+		InHttpBlock: `limit_req_zone $binary_remote_addr zone=api_limit:10m rate={{ .vars.rate }};
+limit_conn_zone $binary_remote_addr zone=addr:10m;
+`,
+	}
+
+	result, err := buildInHttpBlockConfig(cfg, testLocationConfigData())
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expected := "limit_req_zone $binary_remote_addr zone=api_limit:10m rate=10r/s;"
+	if !strings.Contains(result, expected) {
+		t.Errorf("Expected result to contain %q, got: %s", expected, result)
+	}
+
+	validateWithHarness(t, "in_http_block", result)
+}
+
+func TestBuildCacheConfigFlags(t *testing.T) {
+	cacheCfgData := buildProxyCacheConfigData{
+		proxyCacheOnDiskRootPath: "/var/cache/nginx",
+		proxyCacheDefaultFlags:   map[string]string{"inactive": "60m"},
+		proxyCacheKeyZoneSize:    "10m",
+		fastcgiOnDiskRootPath:    "/var/cache/nginx-fastcgi",
+		fastcgiDefaultFlags:      map[string]string{"inactive": "60m"},
+		fastcgiKeyZoneSize:       "10m",
+	}
+	caches := []file_config.CacheConfig{
+		{Name: "first", Flags: map[string]string{"max_size": "1g", "inactive": "10m"}},
+		{Name: "second", Flags: map[string]string{"levels": "1:2"}},
+	}
+	cfg := &file_config.Config{ProxyCaches: caches, FastcgiCaches: caches}
+
+	for name, build := range map[string]func(string, buildProxyCacheConfigData, *file_config.Config) (string, cacheResultingNames, error){
+		"proxy":   buildProxyCacheConfig,
+		"fastcgi": buildFastcgiCacheConfig,
+	} {
+		t.Run(name, func(t *testing.T) {
+			result, _, err := build("app", cacheCfgData, cfg)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+
+			lines := strings.Split(result, "\n")
+			if len(lines) != 2 {
+				t.Fatalf("Expected two cache paths, got: %s", result)
+			}
+			if !strings.Contains(lines[0], "max_size=1g") || !strings.Contains(lines[0], "inactive=10m") {
+				t.Errorf("Expected the first cache to use its flags, got: %s", lines[0])
+			}
+			if strings.Contains(lines[1], "max_size") || !strings.Contains(lines[1], "inactive=60m") || !strings.Contains(lines[1], "levels=1:2") {
+				t.Errorf("Expected the second cache to use the defaults and its own flags only, got: %s", lines[1])
+			}
+		})
+	}
+
+	if len(cacheCfgData.proxyCacheDefaultFlags) != 1 || len(cacheCfgData.fastcgiDefaultFlags) != 1 {
+		t.Errorf("Expected the default flags to be left untouched, got: %v and %v", cacheCfgData.proxyCacheDefaultFlags, cacheCfgData.fastcgiDefaultFlags)
+	}
+}
+
+func TestBuildInServerBlockConfig(t *testing.T) {
+	cfg := &file_config.Config{
+		Vhosts: []file_config.VhostConfig{
+			{
+				ServerName: "api.example.com",
+				Variables: []file_config.VariableConfig{
+					{Name: "max_body_size", Value: "10m"},
+				},
+				Locations: []file_config.LocationConfig{
+					{Named: "fallback", Body: "return 404;"},
+				},
+				InServerBlock: `client_max_body_size 10m;
+add_header X-Upstream {{ .upstreams.default }};
+error_page 404 = @{{ .named_locations.fallback }};
+`,
+			},
+			{
+				ServerName: "www.example.com",
+				Locations: []file_config.LocationConfig{
+					{Uri: "/", Body: "return 200;"},
+				},
+			},
+		},
+	}
+
+	result, err := buildInServerBlockConfig("app", cfg, testLocationConfigData())
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	serverConfig, ok := result["api.example.com"]
+	if !ok {
+		t.Fatalf("Expected server config for api.example.com")
+	}
+
+	for _, expected := range []string{"add_header X-Upstream app-5000;", "error_page 404 = @app_fallback;"} {
+		if !strings.Contains(serverConfig, expected) {
+			t.Errorf("Expected server config to contain %q, got: %s", expected, serverConfig)
+		}
+	}
+
+	if result["www.example.com"] != "" {
+		t.Errorf("Expected empty server config for www.example.com, got: %s", result["www.example.com"])
+	}
+
+	validateWithHarness(t, "in_server_block", serverConfig+"location @app_fallback {\n  return 404;\n}\n")
+}
+
+func TestParseProxyPortMap(t *testing.T) {
+	mappings, err := ParsePortMap("http:80:5000 https:443:5000")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expected := []PortMapping{
+		{Scheme: "http", ListenPort: "80", UpstreamPort: "5000"},
+		{Scheme: "https", ListenPort: "443", UpstreamPort: "5000"},
+	}
+	if len(mappings) != len(expected) {
+		t.Fatalf("Expected %d mappings, got: %d", len(expected), len(mappings))
+	}
+	for i := range expected {
+		if mappings[i] != expected[i] {
+			t.Errorf("Expected %+v, got: %+v", expected[i], mappings[i])
+		}
+	}
+
+	if _, err := ParsePortMap("http:80"); err == nil {
+		t.Errorf("Expected error for malformed port map")
+	}
+}
+
+func TestBuildServerBlockConfig(t *testing.T) {
+	cfg := &file_config.Config{
+		Vhosts: []file_config.VhostConfig{
+			{ServerName: "api.example.com"},
+			{ServerName: "legacy.example.com", Existing: true},
+		},
+	}
+	locationConfigs := vhostToLocationConfigStringMap{
+		"api.example.com":    "location / {\n  return 200;\n}\n",
+		"legacy.example.com": "location / {\n  return 200;\n}\n",
+	}
+	serverConfigs := vhostToServerConfigStringMap{
+		"api.example.com":    "client_max_body_size 10m;\n",
+		"legacy.example.com": "",
+	}
+
+	t.Run("HttpOnly", func(t *testing.T) {
+		result, err := buildServerBlockConfig(cfg, locationConfigs, serverConfigs, &serverBlockConfigData{
+			portMappings: []PortMapping{
+				{Scheme: "http", ListenPort: "8080", UpstreamPort: "5000"},
+				{Scheme: "https", ListenPort: "8443", UpstreamPort: "5000"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		if _, ok := result["legacy.example.com"]; ok {
+			t.Errorf("Expected no server block for existing vhost")
+		}
+
+		expected := `server {
+  listen 8080;
+  listen [::]:8080;
+  server_name api.example.com;
+
+  client_max_body_size 10m;
+
+  location / {
+    return 200;
+  }
+}
+`
+		if result["api.example.com"] != expected {
+			t.Errorf("Expected:\n%s\ngot:\n%s", expected, result["api.example.com"])
+		}
+
+		validateWithHarness(t, "in_http_block", result["api.example.com"])
+	})
+
+	t.Run("WithSsl", func(t *testing.T) {
+		result, err := buildServerBlockConfig(cfg, locationConfigs, serverConfigs, &serverBlockConfigData{
+			portMappings: []PortMapping{
+				{Scheme: "http", ListenPort: "80", UpstreamPort: "5000"},
+				{Scheme: "https", ListenPort: "443", UpstreamPort: "5000"},
+			},
+			sslPath: "/home/dokku/app/tls",
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		for _, expected := range []string{
+			"listen 443 ssl;",
+			"listen [::]:443 ssl;",
+			"ssl_certificate /home/dokku/app/tls/server.crt;",
+			"ssl_certificate_key /home/dokku/app/tls/server.key;",
+		} {
+			if !strings.Contains(result["api.example.com"], expected) {
+				t.Errorf("Expected server block to contain %q, got:\n%s", expected, result["api.example.com"])
+			}
+		}
+	})
+
+	t.Run("Grpc", func(t *testing.T) {
+		result, err := buildServerBlockConfig(cfg, locationConfigs, serverConfigs, &serverBlockConfigData{
+			portMappings: []PortMapping{
+				{Scheme: "grpc", ListenPort: "50051", UpstreamPort: "5000"},
+				{Scheme: "grpcs", ListenPort: "50052", UpstreamPort: "5000"},
+			},
+			sslPath: "/home/dokku/app/tls",
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		for _, expected := range []string{
+			"listen 50051 http2;",
+			"listen [::]:50051 http2;",
+			"listen 50052 ssl http2;",
+			"listen [::]:50052 ssl http2;",
+		} {
+			if !strings.Contains(result["api.example.com"], expected) {
+				t.Errorf("Expected server block to contain %q, got:\n%s", expected, result["api.example.com"])
+			}
+		}
+	})
+
+	t.Run("NoPortMappings", func(t *testing.T) {
+		_, err := buildServerBlockConfig(cfg, locationConfigs, serverConfigs, &serverBlockConfigData{})
+		if err == nil {
+			t.Errorf("Expected error when there is nothing to listen on")
+		}
+	})
+}
+
+func TestBuildUpstreamConfigDirectives(t *testing.T) {
+	cfg := &file_config.Config{
+		Upstreams: []file_config.UpstreamConfig{
+			{
+				SelectDefault:       true,
+				DefaultServersFlags: []file_config.UpstreamServerFlags{},
+				Zone:                "64k",
+				LeastConn:           true,
+				Keepalive: &file_config.UpstreamKeepalive{
+					Connections: 32,
+					Timeout:     "60s",
+				},
+			},
+			{
+				Name: "api",
+				Servers: []file_config.UpstreamServer{
+					{Addr: "127.0.0.1:8001"},
+				},
+				Hash: &file_config.UpstreamHash{Key: "$request_uri", Consistent: true},
+				Keepalive: &file_config.UpstreamKeepalive{
+					Connections: 8,
+					Requests:    1000,
+				},
+			},
+		},
+	}
+
+	result, _, err := buildUpstreamConfig("app", cfg, &upstreamConfigTemplateData{
+		App:                "app",
+		ProxyUpstreamPorts: []string{"5000"},
+		AppListeners:       []Listener{{Host: "10.0.0.2"}},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	for _, expected := range []string{
+		"upstream app-5000 {\n  zone app-5000 64k;\n  least_conn;\n  keepalive 32;\n  keepalive_timeout 60s;\n  server 10.0.0.2:5000;\n}",
+		"upstream app-api {\n  hash $request_uri consistent;\n  keepalive 8;\n  keepalive_requests 1000;\n  server 127.0.0.1:8001;\n}",
+	} {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected upstream config to contain:\n%s\ngot:\n%s", expected, result)
+		}
+	}
+
+	validateWithHarness(t, "upstream", result)
+}
+
+func TestBuildUpstreamConfigSticky(t *testing.T) {
+	cfg := &file_config.Config{
+		Upstreams: []file_config.UpstreamConfig{
+			{
+				SelectDefault: true,
+				Sticky:        &file_config.UpstreamSticky{Cookie: "sessionid"},
+			},
+			{
+				Name:    "api",
+				Servers: []file_config.UpstreamServer{{Addr: "127.0.0.1:8001"}},
+				Sticky:  &file_config.UpstreamSticky{Header: "X-Tenant-Id"},
+			},
+			{
+				Name:    "legacy",
+				Servers: []file_config.UpstreamServer{{Addr: "127.0.0.1:8002"}},
+				Sticky:  &file_config.UpstreamSticky{ClientIp: true},
+			},
+		},
+	}
+
+	result, _, err := buildUpstreamConfig("app", cfg, &upstreamConfigTemplateData{
+		App:                "app",
+		ProxyUpstreamPorts: []string{"5000"},
+		AppListeners:       []Listener{{Host: "10.0.0.2"}, {Host: "10.0.0.3"}},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	for _, expected := range []string{
+		"upstream app-5000 {\n  hash $cookie_sessionid consistent;\n  server 10.0.0.2:5000;\n  server 10.0.0.3:5000;\n}",
+		"upstream app-api {\n  hash $http_x_tenant_id consistent;\n  server 127.0.0.1:8001;\n}",
+		"upstream app-legacy {\n  hash $remote_addr consistent;\n  server 127.0.0.1:8002;\n}",
+	} {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected upstream config to contain:\n%s\ngot:\n%s", expected, result)
+		}
+	}
+
+	validateWithHarness(t, "upstream", result)
+}
+
+func TestBuildUpstreamConfigAppReference(t *testing.T) {
+	cfg := &file_config.Config{
+		Upstreams: []file_config.UpstreamConfig{
+			{Name: "billing", App: "billing-api", Port: 5000},
+		},
+	}
+
+	appListeners := testNamedAppListeners(t, "billing-api=172.17.0.5:5000 billing-api=172.17.0.6:5000 other=172.17.0.7:3000", "web")
+
+	result, upstreams, err := buildUpstreamConfig("app", cfg, &upstreamConfigTemplateData{
+		App:                  "app",
+		UpstreamAppListeners: appListeners,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if upstreams["billing"] != "app-billing" {
+		t.Errorf("Expected upstream name app-billing, got: %s", upstreams["billing"])
+	}
+
+	expected := "upstream app-billing {\n  server 172.17.0.5:5000;\n  server 172.17.0.6:5000;\n}"
+	if !strings.Contains(result, expected) {
+		t.Errorf("Expected upstream config to contain:\n%s\ngot:\n%s", expected, result)
+	}
+
+	t.Run("NoListeners", func(t *testing.T) {
+		_, _, err := buildUpstreamConfig("app", cfg, &upstreamConfigTemplateData{
+			App:                  "app",
+			UpstreamAppListeners: map[string][]Listener{},
+		})
+		if err == nil || !strings.Contains(err.Error(), "app billing-api has no running web listeners") {
+			t.Errorf("Expected missing listeners error, got: %v", err)
+		}
+	})
+
+	t.Run("MalformedEntry", func(t *testing.T) {
+		if _, err := ParseNamedListeners("billing-api"); err == nil {
+			t.Errorf("Expected error for malformed entry")
+		}
+	})
+}
+
+func TestBuildUpstreamConfigIPv6Listeners(t *testing.T) {
+	cfg := &file_config.Config{
+		Upstreams: []file_config.UpstreamConfig{
+			{
+				SelectDefault: true,
+				DefaultServersFlags: []file_config.UpstreamServerFlags{
+					{Selector: `^\[fd00::5\]:5000$`, Flags: map[string]string{"weight": "3"}},
+				},
+			},
+			{
+				Name: "php",
+				Servers: []file_config.UpstreamServer{
+					{Addr: "unix:/var/run/php/php8.1-fpm.sock"},
+				},
+			},
+		},
+	}
+
+	result, _, err := buildUpstreamConfig("app", cfg, &upstreamConfigTemplateData{
+		App:                "app",
+		ProxyUpstreamPorts: []string{"5000"},
+		AppListeners:       testAppListeners(t, "web", "[fd00::5]:5000", "10.0.0.2:5000"),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	for _, expected := range []string{
+		"upstream app-5000 {\n  server [fd00::5]:5000 weight=3;\n  server 10.0.0.2:5000;\n}",
+		"upstream app-php {\n  server unix:/var/run/php/php8.1-fpm.sock;\n}",
+	} {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected upstream config to contain:\n%s\ngot:\n%s", expected, result)
+		}
+	}
+
+	if _, err := NewListeners("web", []string{"fd00::5"}); err == nil {
+		t.Errorf("Expected error for unbracketed ipv6 listener")
+	}
+}
+
+func TestBuildUpstreamConfigPlaceholder(t *testing.T) {
+	cfg := &file_config.Config{
+		Upstreams: []file_config.UpstreamConfig{
+			{
+				SelectDefault: true,
+				DefaultServersFlags: []file_config.UpstreamServerFlags{
+					{Flags: map[string]string{"weight": "3"}},
+				},
+			},
+		},
+	}
+
+	result, upstreams, err := buildUpstreamConfig("app", cfg, &upstreamConfigTemplateData{
+		App:                "app",
+		ProxyUpstreamPorts: []string{"5000"},
+		AppListeners:       []Listener{},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if upstreams["default"] != "app-5000" {
+		t.Errorf("Expected default upstream app-5000, got: %s", upstreams["default"])
+	}
+
+	expected := "upstream app-5000 {\n  # no running servers, placeholder until the app is scaled up\n  server 127.0.0.1:1 down;\n}"
+	if !strings.Contains(result, expected) {
+		t.Errorf("Expected upstream config to contain:\n%s\ngot:\n%s", expected, result)
+	}
+
+	validateWithHarness(t, "upstream", result)
+}
+
+func TestBuildServerBlockConfigErrorPages(t *testing.T) {
+	cfg := &file_config.Config{
+		Vhosts: []file_config.VhostConfig{
+			{ServerName: "api.example.com"},
+		},
+	}
+
+	result, err := buildServerBlockConfig(cfg, vhostToLocationConfigStringMap{}, vhostToServerConfigStringMap{}, &serverBlockConfigData{
+		portMappings:        []PortMapping{{Scheme: "http", ListenPort: "8080", UpstreamPort: "5000"}},
+		errorPagesDirectory: "/var/lib/dokku/data/nginx-custom/dokku-errors",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expected := `  error_page 502 /502-error.html;
+  location = /502-error.html {
+    root /var/lib/dokku/data/nginx-custom/dokku-errors;
+    internal;
+  }
+}
+`
+	if !strings.HasSuffix(result["api.example.com"], expected) {
+		t.Errorf("Expected server block to end with:\n%s\ngot:\n%s", expected, result["api.example.com"])
+	}
+}
+
+func TestExistingServerConfigErrorPages(t *testing.T) {
+	errorPagesDirectory := "/var/lib/dokku/data/nginx-custom/dokku-errors"
+	expected := `client_max_body_size 10m;
+
+error_page 502 /502-error.html;
+location = /502-error.html {
+  root /var/lib/dokku/data/nginx-custom/dokku-errors;
+  internal;
+}
+`
+	if result := existingServerConfig("client_max_body_size 10m;\n", errorPagesDirectory); result != expected {
+		t.Errorf("Expected server config:\n%s\ngot:\n%s", expected, result)
+	}
+	if result := existingServerConfig("", errorPagesDirectory); !strings.HasPrefix(result, "error_page 502 /502-error.html;") {
+		t.Errorf("Expected server config to serve the error page, got:\n%s", result)
+	}
+	if result := existingServerConfig("client_max_body_size 10m;\n", ""); result != "client_max_body_size 10m;\n" {
+		t.Errorf("Expected server config without error pages to be left alone, got:\n%s", result)
+	}
+}
+
+func TestBuildUpstreamConfigProcessTypes(t *testing.T) {
+	cfg := &file_config.Config{
+		Upstreams: []file_config.UpstreamConfig{
+			{
+				SelectProcess:     "ws",
+				SelectProcessPort: 8080,
+				IpHash:            true,
+			},
+			{
+				SelectProcess:     "grpc",
+				SelectProcessPort: 9000,
+			},
+		},
+	}
+
+	processListeners := testNamedAppListeners(t, "ws=172.17.0.8:5000 ws=172.17.0.9:5000", "")
+
+	result, upstreams, err := buildUpstreamConfig("app", cfg, &upstreamConfigTemplateData{
+		App:                "app",
+		ProxyUpstreamPorts: []string{"5000"},
+		AppListeners:       []Listener{{Host: "172.17.0.2", ProcessType: "web"}},
+		ProcessListeners:   processListeners,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expectedNames := map[string]string{
+		"default":   "app-5000",
+		"ws":        "app-ws-8080",
+		"ws-8080":   "app-ws-8080",
+		"grpc":      "app-grpc-9000",
+		"grpc-9000": "app-grpc-9000",
+	}
+	for refName, expected := range expectedNames {
+		if upstreams[refName] != expected {
+			t.Errorf("Expected upstream %s to be %s, got: %s", refName, expected, upstreams[refName])
+		}
+	}
+
+	for _, expected := range []string{
+		"upstream app-ws-8080 {\n  ip_hash;\n  server 172.17.0.8:8080;\n  server 172.17.0.9:8080;\n}",
+		"upstream app-grpc-9000 {\n  # no running servers, placeholder until the app is scaled up\n  server 127.0.0.1:1 down;\n}",
+	} {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected upstream config to contain:\n%s\ngot:\n%s", expected, result)
+		}
+	}
+
+	out, err := sigil.Execute([]byte("proxy_pass http://{{ .upstreams.ws }};"), map[string]any{"upstreams": upstreams}, "process_upstream_ref")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if out.String() != "proxy_pass http://app-ws-8080;" {
+		t.Errorf("Expected process upstream to be exposed to templates, got: %s", out.String())
+	}
+
+	t.Run("NameConflict", func(t *testing.T) {
+		conflicting := &file_config.Config{
+			Upstreams: []file_config.UpstreamConfig{
+				{SelectProcess: "ws", SelectProcessPort: 8080},
+				{Name: "ws", Servers: []file_config.UpstreamServer{{Addr: "127.0.0.1:8080"}}},
+			},
+		}
+		_, _, err := buildUpstreamConfig("app", conflicting, &upstreamConfigTemplateData{App: "app"})
+		if err == nil {
+			t.Errorf("Expected error for conflicting upstream name")
+		}
+	})
+}
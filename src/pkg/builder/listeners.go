@@ -0,0 +1,77 @@
+package builder
+
+import (
+	"dokku-nginx-custom/src/pkg/file_config"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Listener is a running container as reported by Dokku. Only the host is
+// kept, the upstream port comes from the port map or the upstream config.
+type Listener struct {
+	Host           string `json:"ip" yaml:"ip"`
+	ProcessType    string `json:"process_type" yaml:"process_type"`
+	ContainerIndex int    `json:"container_index" yaml:"container_index"`
+	ContainerName  string `json:"container_name" yaml:"container_name"`
+}
+
+// addr returns the normalized server address of the listener for port.
+func (l Listener) addr(port string) (string, error) {
+	return file_config.NormalizeUpstreamAddr(net.JoinHostPort(l.Host, port))
+}
+
+// NewListeners builds listeners out of flat host:port entries, IPv6 hosts
+// being bracketed. Flat entries carry no container metadata beyond the
+// process type they were requested for.
+func NewListeners(processType string, listeners []string) ([]Listener, error) {
+	appListeners := make([]Listener, 0, len(listeners))
+	for _, listener := range listeners {
+		host, _, err := net.SplitHostPort(listener)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse listener %s: %w", listener, err)
+		}
+		appListeners = append(appListeners, Listener{
+			Host:        host,
+			ProcessType: processType,
+		})
+	}
+	return appListeners, nil
+}
+
+// ParseNamedListeners parses space-separated name=listener entries, as found
+// in DOKKU_UPSTREAM_APP_LISTENERS and DOKKU_PROCESS_LISTENERS.
+func ParseNamedListeners(value string) (map[string][]string, error) {
+	namedListeners := make(map[string][]string)
+	for _, entry := range strings.Fields(value) {
+		entrySplit := strings.SplitN(entry, "=", 2)
+		if len(entrySplit) != 2 || entrySplit[0] == "" || entrySplit[1] == "" {
+			return nil, fmt.Errorf("failed to parse listener entry %s", entry)
+		}
+		namedListeners[entrySplit[0]] = append(namedListeners[entrySplit[0]], entrySplit[1])
+	}
+	return namedListeners, nil
+}
+
+// ParseListenersJSON parses the container metadata of
+// DOKKU_APP_LISTENERS_JSON and groups it by process type.
+func ParseListenersJSON(value string) (map[string][]Listener, error) {
+	var listeners []Listener
+	if err := json.Unmarshal([]byte(value), &listeners); err != nil {
+		return nil, fmt.Errorf("failed to parse listeners json: %w", err)
+	}
+	return groupListeners(listeners)
+}
+
+// groupListeners groups listeners by process type.
+func groupListeners(listeners []Listener) (map[string][]Listener, error) {
+	byProcessType := make(map[string][]Listener)
+	for _, listener := range listeners {
+		if listener.Host == "" || listener.ProcessType == "" {
+			return nil, fmt.Errorf("listener %+v is missing its ip or process type", listener)
+		}
+		byProcessType[listener.ProcessType] = append(byProcessType[listener.ProcessType], listener)
+	}
+	return byProcessType, nil
+}
@@ -0,0 +1,144 @@
+package builder
+
+import (
+	"dokku-nginx-custom/src/pkg/file_config"
+	"strings"
+	"testing"
+)
+
+func testAppListeners(t *testing.T, processType string, listeners ...string) []Listener {
+	t.Helper()
+	appListeners, err := NewListeners(processType, listeners)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	return appListeners
+}
+
+// testNamedAppListeners parses name=listener entries, the process type
+// defaulting to the entry name when empty
+func testNamedAppListeners(t *testing.T, value string, processType string) map[string][]Listener {
+	t.Helper()
+	namedListeners, err := ParseNamedListeners(value)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	appListeners := make(map[string][]Listener)
+	for name, listeners := range namedListeners {
+		listenerProcessType := processType
+		if listenerProcessType == "" {
+			listenerProcessType = name
+		}
+		appListeners[name] = testAppListeners(t, listenerProcessType, listeners...)
+	}
+	return appListeners
+}
+
+func TestParseAppListenersJSON(t *testing.T) {
+	listeners, err := ParseListenersJSON(`[
+		{"ip": "172.17.0.2", "process_type": "web", "container_index": 1, "container_name": "app.web.1"},
+		{"ip": "fd00::3", "process_type": "web", "container_index": 2, "container_name": "app.web.2"},
+		{"ip": "172.17.0.4", "process_type": "worker", "container_index": 1, "container_name": "app.worker.1"}
+	]`)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(listeners["web"]) != 2 || len(listeners["worker"]) != 1 {
+		t.Fatalf("Expected 2 web and 1 worker listeners, got: %+v", listeners)
+	}
+	expected := Listener{Host: "fd00::3", ProcessType: "web", ContainerIndex: 2, ContainerName: "app.web.2"}
+	if listeners["web"][1] != expected {
+		t.Errorf("Expected %+v, got: %+v", expected, listeners["web"][1])
+	}
+
+	addr, err := listeners["web"][1].addr("5000")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if addr != "[fd00::3]:5000" {
+		t.Errorf("Expected [fd00::3]:5000, got: %s", addr)
+	}
+
+	t.Run("MissingIp", func(t *testing.T) {
+		if _, err := ParseListenersJSON(`[{"process_type": "web"}]`); err == nil {
+			t.Errorf("Expected error for listener without ip")
+		}
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		if _, err := ParseListenersJSON(`172.17.0.2:5000`); err == nil {
+			t.Errorf("Expected error for malformed json")
+		}
+	})
+}
+
+func TestBuildUpstreamConfigStructuredSelectors(t *testing.T) {
+	listeners, err := ParseListenersJSON(`[
+		{"ip": "172.17.0.2", "process_type": "web", "container_index": 1, "container_name": "app.web.1"},
+		{"ip": "172.17.0.3", "process_type": "web", "container_index": 2, "container_name": "app.web.2"},
+		{"ip": "172.17.0.4", "process_type": "web", "container_index": 3, "container_name": "app.web.3"}
+	]`)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	cfg := &file_config.Config{
+		Upstreams: []file_config.UpstreamConfig{
+			{
+				SelectDefault: true,
+				DefaultServersFlags: []file_config.UpstreamServerFlags{
+					{ContainerIndex: 1, Flags: map[string]string{"max_fails": "5"}},
+					{ContainerName: "app.web.[12]", ContainerIndex: 2, ProcessType: "web", Flags: map[string]string{"max_fails": "3"}},
+					{ContainerName: "app.web.*", Selector: `\.4:`, Flags: map[string]string{"backup": ""}},
+					{ProcessType: "worker", Flags: map[string]string{"down": ""}},
+				},
+			},
+			{
+				Name: "static",
+				Servers: []file_config.UpstreamServer{
+					{Addr: "127.0.0.1:8001"},
+				},
+			},
+		},
+	}
+
+	result, _, err := buildUpstreamConfig("app", cfg, &upstreamConfigTemplateData{
+		App:                "app",
+		ProxyUpstreamPorts: []string{"5000"},
+		AppListeners:       listeners["web"],
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	for _, expected := range []string{
+		"upstream app-5000 {\n  server 172.17.0.2:5000 max_fails=5;\n  server 172.17.0.3:5000 max_fails=3;\n  server 172.17.0.4:5000 backup;\n}",
+		"upstream app-static {\n  server 127.0.0.1:8001;\n}",
+	} {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected upstream config to contain:\n%s\ngot:\n%s", expected, result)
+		}
+	}
+
+	t.Run("InvalidGlob", func(t *testing.T) {
+		cfg := &file_config.Config{
+			Upstreams: []file_config.UpstreamConfig{
+				{
+					SelectDefault: true,
+					DefaultServersFlags: []file_config.UpstreamServerFlags{
+						{ContainerName: "app.web.[", Flags: map[string]string{"weight": "5"}},
+					},
+				},
+			},
+		}
+		_, _, err := buildUpstreamConfig("app", cfg, &upstreamConfigTemplateData{
+			App:                "app",
+			ProxyUpstreamPorts: []string{"5000"},
+			AppListeners:       listeners["web"],
+		})
+		if err == nil || !strings.Contains(err.Error(), "invalid container_name glob") {
+			t.Errorf("Expected invalid glob error, got: %v", err)
+		}
+	})
+}
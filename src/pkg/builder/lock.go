@@ -0,0 +1,127 @@
+package builder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"syscall"
+	"time"
+)
+
+// lockPollInterval is how often a held lock is retried
+const lockPollInterval = 100 * time.Millisecond
+
+// lockOwner is written into a lock file by the process holding it, so that
+// waiting processes can tell who they are waiting for
+type lockOwner struct {
+	Pid int    `json:"pid"`
+	App string `json:"app"`
+}
+
+func (o lockOwner) String() string {
+	if o.Pid == 0 {
+		return "an unknown process"
+	}
+	return fmt.Sprintf("pid %d (app %s)", o.Pid, o.App)
+}
+
+// fileLock is an exclusive flock(2) on a lock file, released when the
+// process exits
+type fileLock struct {
+	file *os.File
+}
+
+// acquireFileLock takes the exclusive lock on lockPath for app, waiting up to
+// timeout for the current holder to release it. The wait is logged to logger.
+func acquireFileLock(lockPath string, name string, app string, timeout time.Duration, logger *log.Logger) (*fileLock, error) {
+	if err := os.MkdirAll(path.Dir(lockPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s lock: %w", name, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s lock: %w", name, err)
+		}
+
+		owner := readLockOwner(file)
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, fmt.Errorf("timed out after %s waiting for %s lock held by %s", timeout, name, owner)
+		}
+		if !waiting {
+			logger.Printf("waiting for %s lock held by %s", name, owner)
+			waiting = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	if err := writeLockOwner(file, lockOwner{Pid: os.Getpid(), App: app}); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to record %s lock owner: %w", name, err)
+	}
+
+	return &fileLock{file: file}, nil
+}
+
+func (l *fileLock) release() {
+	l.file.Truncate(0)
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+}
+
+func readLockOwner(file *os.File) lockOwner {
+	var owner lockOwner
+	content, err := io.ReadAll(io.NewSectionReader(file, 0, 1<<16))
+	if err != nil {
+		return owner
+	}
+	json.Unmarshal(content, &owner)
+	return owner
+}
+
+func writeLockOwner(file *os.File, owner lockOwner) error {
+	content, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = file.WriteAt(content, 0)
+	return err
+}
+
+// buildLocks serializes the processes touching nginx configs: builds of an
+// app hold its build lock, and switching current, nginx -t and reloads hold
+// the global lock since nginx -t reads the configs of every app.
+type buildLocks struct {
+	app            string
+	appLockPath    string
+	globalLockPath string
+	timeout        time.Duration
+	logger         *log.Logger
+}
+
+func (l *buildLocks) lockApp() (*fileLock, error) {
+	return acquireFileLock(l.appLockPath, "build", l.app, l.timeout, l.logger)
+}
+
+func (l *buildLocks) lockGlobal() (*fileLock, error) {
+	return acquireFileLock(l.globalLockPath, "global nginx", l.app, l.timeout, l.logger)
+}
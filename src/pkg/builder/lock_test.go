@@ -0,0 +1,49 @@
+package builder
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireFileLock(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "app-config", "build.lock")
+
+	lock, err := acquireFileLock(lockPath, "build", "first", time.Second, log.Default())
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	_, err = acquireFileLock(lockPath, "build", "second", 300*time.Millisecond, log.Default())
+	expected := fmt.Sprintf("timed out after 300ms waiting for build lock held by pid %d (app first)", os.Getpid())
+	if err == nil || !strings.Contains(err.Error(), expected) {
+		t.Errorf("Expected error to contain %q, got: %v", expected, err)
+	}
+
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		lock.release()
+		close(released)
+	}()
+
+	// Waits for the first lock to be released
+	second, err := acquireFileLock(lockPath, "build", "second", 5*time.Second, log.Default())
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	<-released
+
+	content, err := os.ReadFile(lockPath)
+	if err != nil {
+		t.Fatalf("Failed to read lock file: %v", err)
+	}
+	if !strings.Contains(string(content), `"app":"second"`) {
+		t.Errorf("Expected lock file to record the new owner, got: %s", content)
+	}
+	second.release()
+}
@@ -0,0 +1,182 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"dokku-nginx-custom/src/pkg/file_config"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"time"
+)
+
+const manifestFilename = "manifest.json"
+
+type manifestConfig struct {
+	Path   string `json:"path"`
+	Sha256 string `json:"sha256"`
+}
+
+type manifestSource struct {
+	Image  string `json:"image"`
+	GitRev string `json:"git_rev"`
+}
+
+// releaseManifest records what produced a release, written next to its
+// config files as manifest.json
+type releaseManifest struct {
+	App            string            `json:"app"`
+	BuiltAt        time.Time         `json:"built_at"`
+	BuilderVersion string            `json:"builder_version"`
+	Config         manifestConfig    `json:"config"`
+	Source         manifestSource    `json:"source"`
+	Env            map[string]string `json:"env"`
+	// Files maps every config file of the release to its sha256
+	Files map[string]string `json:"files"`
+	// SSL maps the cert files the release points nginx at to their sha256,
+	// nginx only reads new certs on a reload
+	SSL map[string]string `json:"ssl,omitempty"`
+	// ProbesSha256 is the sha256 of the probes of the config, a change of
+	// probes alone still deploys a release to run them against
+	ProbesSha256 string `json:"probes_sha256,omitempty"`
+	// Probes are the results of the config probes run after the reload
+	Probes []probeResult `json:"probes,omitempty"`
+}
+
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// configFileHashes maps config files to the sha256 of their content.
+func configFileHashes(configFiles map[string]string) map[string]string {
+	files := make(map[string]string, len(configFiles))
+	for filename, content := range configFiles {
+		files[filename] = sha256Hex([]byte(content))
+	}
+	return files
+}
+
+// sslFileHashes maps the cert files in sslPath to the sha256 of their
+// content, nil when the app has no certs.
+func sslFileHashes(sslPath string) (map[string]string, error) {
+	if sslPath == "" {
+		return nil, nil
+	}
+	hashes := make(map[string]string, 2)
+	for _, filename := range []string{"server.crt", "server.key"} {
+		content, err := os.ReadFile(path.Join(sslPath, filename))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cert file: %w", err)
+		}
+		hashes[filename] = sha256Hex(content)
+	}
+	return hashes, nil
+}
+
+// probesHash returns the sha256 of the JSON encoding of probes, empty when
+// there are none.
+func probesHash(probes []file_config.ProbeConfig) (string, error) {
+	if len(probes) == 0 {
+		return "", nil
+	}
+	content, err := json.Marshal(probes)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode probes: %w", err)
+	}
+	return sha256Hex(content), nil
+}
+
+// newReleaseManifest builds the manifest of a release rendered from the
+// config of opts into configFiles, with the given probes.
+func newReleaseManifest(opts Options, probes []file_config.ProbeConfig, configFiles map[string]string, builtAt time.Time) (*releaseManifest, error) {
+	configContent, err := os.ReadFile(opts.ConfigFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	sslHashes, err := sslFileHashes(opts.SSLPath)
+	if err != nil {
+		return nil, err
+	}
+
+	probesSha256, err := probesHash(probes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &releaseManifest{
+		App:            opts.AppName,
+		BuiltAt:        builtAt.UTC(),
+		BuilderVersion: opts.BuilderVersion,
+		Config: manifestConfig{
+			Path:   opts.ConfigFilePath,
+			Sha256: sha256Hex(configContent),
+		},
+		Source: manifestSource{
+			Image:  opts.SourceImage,
+			GitRev: opts.SourceGitRev,
+		},
+		Env:          opts.Env,
+		Files:        configFileHashes(configFiles),
+		SSL:          sslHashes,
+		ProbesSha256: probesSha256,
+	}, nil
+}
+
+func writeReleaseManifest(releaseDir string, manifest *releaseManifest) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	return copyConfigToRelease(string(content)+"\n", releaseDir, manifestFilename)
+}
+
+// readReleaseManifest returns the manifest of a release, nil for releases
+// built before manifests were written.
+func readReleaseManifest(releaseDir string) (*releaseManifest, error) {
+	content, err := os.ReadFile(path.Join(releaseDir, manifestFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var manifest releaseManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest of %s: %w", path.Base(releaseDir), err)
+	}
+	return &manifest, nil
+}
+
+// releaseMatches tells whether the release at releaseDir would be built
+// again by opts with the given probes from configFiles, according to its
+// manifest: same config files, certs, probes, env and builder version. The
+// config file itself, the source and the build time are left out, they do
+// not change what nginx serves. Releases without a manifest never match.
+func releaseMatches(releaseDir string, opts Options, probes []file_config.ProbeConfig, configFiles map[string]string) (bool, error) {
+	manifest, err := readReleaseManifest(releaseDir)
+	if err != nil || manifest == nil {
+		return false, err
+	}
+
+	sslHashes, err := sslFileHashes(opts.SSLPath)
+	if err != nil {
+		return false, err
+	}
+
+	probesSha256, err := probesHash(probes)
+	if err != nil {
+		return false, err
+	}
+
+	return maps.Equal(manifest.Files, configFileHashes(configFiles)) &&
+		maps.Equal(manifest.SSL, sslHashes) &&
+		manifest.ProbesSha256 == probesSha256 &&
+		maps.Equal(manifest.Env, opts.Env) &&
+		manifest.BuilderVersion == opts.BuilderVersion, nil
+}
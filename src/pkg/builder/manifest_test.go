@@ -0,0 +1,66 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReleaseManifest(t *testing.T) {
+	tempDir := t.TempDir()
+	configFilePath := filepath.Join(tempDir, "nginx.yaml")
+	if err := os.WriteFile(configFilePath, []byte("vhosts: []\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	configFiles := map[string]string{
+		"upstreams.conf":                    "upstream app-5000 {}\n",
+		"vhosts/api.example.com/vhost.conf": "",
+	}
+
+	manifest, err := newReleaseManifest(Options{
+		AppName:        "app",
+		ConfigFilePath: configFilePath,
+		SourceImage:    "dokku/app:latest",
+		SourceGitRev:   "0123456789abcdef0123456789abcdef01234567",
+		Env:            map[string]string{"PROXY_PORT_MAP": "http:80:5000"},
+		BuilderVersion: "0.1.0",
+	}, nil, configFiles, buildTime)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	releaseDir := filepath.Join(tempDir, "release-20011225.1")
+	if err := writeReleaseManifest(releaseDir, manifest); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	read, err := readReleaseManifest(releaseDir)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if read.App != "app" || !read.BuiltAt.Equal(buildTime) || read.BuilderVersion != "0.1.0" {
+		t.Errorf("Unexpected manifest header: %+v", read)
+	}
+	// sha256 of "vhosts: []\n"
+	if read.Config.Path != configFilePath || read.Config.Sha256 != sha256Hex([]byte("vhosts: []\n")) {
+		t.Errorf("Unexpected config provenance: %+v", read.Config)
+	}
+	if read.Source.Image != "dokku/app:latest" || read.Source.GitRev != "0123456789abcdef0123456789abcdef01234567" {
+		t.Errorf("Unexpected source: %+v", read.Source)
+	}
+	if read.Env["PROXY_PORT_MAP"] != "http:80:5000" {
+		t.Errorf("Expected PROXY_PORT_MAP in env, got: %v", read.Env)
+	}
+	if read.Files["vhosts/api.example.com/vhost.conf"] != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("Unexpected file hashes: %v", read.Files)
+	}
+
+	t.Run("MissingManifest", func(t *testing.T) {
+		manifest, err := readReleaseManifest(filepath.Join(tempDir, "release-20011224.1"))
+		if err != nil || manifest != nil {
+			t.Errorf("Expected no manifest and no error, got: %+v, %v", manifest, err)
+		}
+	})
+}
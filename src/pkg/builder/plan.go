@@ -0,0 +1,184 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+)
+
+// Changes are the differences between the config a build would produce and
+// the release current points at. Paths are relative to the release.
+type Changes struct {
+	// Current is the release current points at, empty before the first
+	// build
+	Current string
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+// HasChanges tells whether a build would change any config file
+func (c *Changes) HasChanges() bool {
+	return len(c.Added)+len(c.Removed)+len(c.Changed) > 0
+}
+
+// Plan renders the config of opts into a temporary directory and prints to
+// out the files a build would add, remove or change, followed by a unified
+// diff of each of them against current. Nothing of the app's data directory
+// nor nginx is touched.
+func Plan(ctx context.Context, opts Options, out io.Writer) (*Changes, error) {
+	if err := opts.checkRequired("AppName", "ConfigFilePath", "DataRootDirectory", "ProxyName"); err != nil {
+		return nil, err
+	}
+
+	planDir, err := os.MkdirTemp("", "nginx-config-plan-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create plan directory: %w", err)
+	}
+	defer os.RemoveAll(planDir)
+
+	result, err := Render(ctx, opts, planDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range result.Warnings {
+		opts.logger().Println(warning)
+	}
+
+	currentDir, err := getPreviousVersionDirectory(opts.configDirectory())
+	if err != nil {
+		return nil, err
+	}
+	currentFiles := make(map[string]bool)
+	if currentDir != "" {
+		files, err := listReleaseFiles(currentDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list current release: %w", err)
+		}
+		for _, file := range files {
+			currentFiles[file] = true
+		}
+	}
+
+	changes := &Changes{}
+	if currentDir != "" {
+		changes.Current = filepath.Base(currentDir)
+	}
+	for _, file := range result.Files {
+		if !currentFiles[file] {
+			changes.Added = append(changes.Added, file)
+			continue
+		}
+		delete(currentFiles, file)
+		same, err := sameFileContent(filepath.Join(currentDir, file), filepath.Join(planDir, file))
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			changes.Changed = append(changes.Changed, file)
+		}
+	}
+	for file := range currentFiles {
+		changes.Removed = append(changes.Removed, file)
+	}
+	sort.Strings(changes.Removed)
+
+	if changes.Current == "" {
+		fmt.Fprintln(out, "no current release, every file is added")
+	}
+	if !changes.HasChanges() {
+		fmt.Fprintf(out, "no changes, the config matches %s\n", changes.Current)
+		return changes, nil
+	}
+	for _, summary := range []struct {
+		label string
+		files []string
+	}{
+		{"added", changes.Added},
+		{"removed", changes.Removed},
+		{"changed", changes.Changed},
+	} {
+		for _, file := range summary.files {
+			fmt.Fprintf(out, "%-8s %s\n", summary.label+":", file)
+		}
+	}
+	fmt.Fprintf(out, "%d added, %d removed, %d changed\n\n", len(changes.Added), len(changes.Removed), len(changes.Changed))
+
+	diffs := make(map[string][2]string)
+	for _, file := range changes.Added {
+		diffs[file] = [2]string{os.DevNull, filepath.Join(planDir, file)}
+	}
+	for _, file := range changes.Removed {
+		diffs[file] = [2]string{filepath.Join(currentDir, file), os.DevNull}
+	}
+	for _, file := range changes.Changed {
+		diffs[file] = [2]string{filepath.Join(currentDir, file), filepath.Join(planDir, file)}
+	}
+	files := make([]string, 0, len(diffs))
+	for file := range diffs {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		if err := diffFiles(ctx, out, "current/"+file, diffs[file][0], "planned/"+file, diffs[file][1]); err != nil {
+			return nil, err
+		}
+	}
+
+	return changes, nil
+}
+
+// listReleaseFiles returns the config files of a release relative to it, the
+// manifest left out.
+func listReleaseFiles(releaseDir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(releaseDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		relPath, err := filepath.Rel(releaseDir, p)
+		if err != nil {
+			return err
+		}
+		if relPath != manifestFilename {
+			files = append(files, filepath.ToSlash(relPath))
+		}
+		return nil
+	})
+	return files, err
+}
+
+func sameFileContent(a string, b string) (bool, error) {
+	aContent, err := os.ReadFile(a)
+	if err != nil {
+		return false, err
+	}
+	bContent, err := os.ReadFile(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aContent, bContent), nil
+}
+
+// diffFiles prints a unified diff of two files under the given labels.
+func diffFiles(ctx context.Context, out io.Writer, fromLabel string, fromPath string, toLabel string, toPath string) error {
+	cmd := exec.CommandContext(ctx, "diff", "-u", "--label", fromLabel, "--label", toLabel, fromPath, toPath)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		// diff exits with 1 when the files differ
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return nil
+		}
+		return fmt.Errorf("failed to diff %s: %w", toLabel, err)
+	}
+	return nil
+}
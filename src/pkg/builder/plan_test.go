@@ -0,0 +1,99 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	t.Run("NoCurrentRelease", func(t *testing.T) {
+		opts := newTestBuildOptions(t)
+		var out bytes.Buffer
+		changes, err := Plan(context.Background(), opts, &out)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if !changes.HasChanges() || len(changes.Removed) != 0 || len(changes.Changed) != 0 {
+			t.Errorf("Expected every file to be added, got: %+v", changes)
+		}
+		if !strings.Contains(out.String(), "no current release") {
+			t.Errorf("Expected the missing current release to be reported, got:\n%s", out.String())
+		}
+		if _, err := os.Stat(opts.configDirectory()); !os.IsNotExist(err) {
+			t.Errorf("Expected no release to be created, got: %v", err)
+		}
+	})
+
+	t.Run("Unchanged", func(t *testing.T) {
+		opts := newTestBuildOptions(t)
+		if _, err := Build(context.Background(), opts); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		var out bytes.Buffer
+		changes, err := Plan(context.Background(), opts, &out)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if changes.HasChanges() {
+			t.Errorf("Expected no changes, got: %+v", changes)
+		}
+		if !strings.Contains(out.String(), "no changes") {
+			t.Errorf("Expected no changes to be reported, got:\n%s", out.String())
+		}
+	})
+
+	t.Run("Changed", func(t *testing.T) {
+		opts := newTestBuildOptions(t)
+		if _, err := Build(context.Background(), opts); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		config := `vhosts:
+  - server_name: www.example.com
+    locations:
+      - uri: /
+        body: proxy_pass http://{{ .upstreams.default }};
+`
+		if err := os.WriteFile(opts.ConfigFilePath, []byte(config), 0644); err != nil {
+			t.Fatalf("Failed to write config file: %v", err)
+		}
+		opts.AppListeners = append(opts.AppListeners, Listener{Host: "172.17.0.3", ProcessType: "web"})
+
+		var out bytes.Buffer
+		changes, err := Plan(context.Background(), opts, &out)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if !reflect.DeepEqual(changes.Added, []string{"vhosts/www.example.com/vhost.conf"}) {
+			t.Errorf("Expected the new vhost to be added, got: %v", changes.Added)
+		}
+		if !reflect.DeepEqual(changes.Removed, []string{"vhosts/api.example.com/vhost.conf"}) {
+			t.Errorf("Expected the old vhost to be removed, got: %v", changes.Removed)
+		}
+		if !reflect.DeepEqual(changes.Changed, []string{"upstreams.conf"}) {
+			t.Errorf("Expected the upstreams to change, got: %v", changes.Changed)
+		}
+
+		for _, expected := range []string{
+			"added:   vhosts/www.example.com/vhost.conf",
+			"1 added, 1 removed, 1 changed",
+			"--- current/upstreams.conf",
+			"+++ planned/upstreams.conf",
+			"+  server 172.17.0.3:5000;",
+			"--- current/vhosts/api.example.com/vhost.conf",
+		} {
+			if !strings.Contains(out.String(), expected) {
+				t.Errorf("Expected plan output to contain %q, got:\n%s", expected, out.String())
+			}
+		}
+
+		if current := currentRelease(t, opts.configDirectory()); current != changes.Current {
+			t.Errorf("Expected current to stay %s, got: %s", changes.Current, current)
+		}
+	})
+}
@@ -0,0 +1,181 @@
+package builder
+
+import (
+	"context"
+	"crypto/tls"
+	"dokku-nginx-custom/src/pkg/file_config"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// probeTimeout bounds a single probe request
+const probeTimeout = 10 * time.Second
+
+// probeBodyLimit is how much of a response body is matched against a probe
+const probeBodyLimit = 1 << 20
+
+// probeResult is the outcome of a probe, recorded in the release manifest
+type probeResult struct {
+	Path           string `json:"path"`
+	Host           string `json:"host"`
+	Scheme         string `json:"scheme"`
+	Port           int    `json:"port"`
+	ExpectedStatus int    `json:"expected_status"`
+	Status         int    `json:"status"`
+	Passed         bool   `json:"passed"`
+	Error          string `json:"error,omitempty"`
+	DurationMs     int64  `json:"duration_ms"`
+}
+
+// prober sends the probes of a config to the local nginx listener
+type prober struct {
+	// addr is the address nginx listens on, e.g. 127.0.0.1
+	addr        string
+	defaultPort int
+	// schemes maps the listen ports of the app's port mappings to their
+	// scheme, other ports are probed over http
+	schemes map[int]string
+}
+
+func newProber(addr string, portMappings []PortMapping) *prober {
+	p := &prober{
+		addr:    addr,
+		schemes: make(map[int]string, len(portMappings)),
+	}
+	for _, mapping := range portMappings {
+		port, err := strconv.Atoi(mapping.ListenPort)
+		if err != nil || (mapping.Scheme != "http" && mapping.Scheme != "https") {
+			continue
+		}
+		if _, ok := p.schemes[port]; !ok {
+			p.schemes[port] = mapping.Scheme
+		}
+	}
+	p.defaultPort = defaultProbePort(portMappings)
+	return p
+}
+
+// defaultProbePort returns the listen port of the first http port mapping,
+// of the first https one when the app has no http mapping, 0 when it has
+// neither.
+func defaultProbePort(portMappings []PortMapping) int {
+	for _, scheme := range []string{"http", "https"} {
+		for _, mapping := range portMappings {
+			if mapping.Scheme != scheme {
+				continue
+			}
+			if port, err := strconv.Atoi(mapping.ListenPort); err == nil {
+				return port
+			}
+		}
+	}
+	return 0
+}
+
+// newClient returns the client sending a probe. https probes are sent with
+// the probe host as SNI, so nginx picks the vhost's server block, and skip
+// cert verification since nginx is reached by its local address.
+func (p *prober) newClient(scheme string, host string) *http.Client {
+	client := &http.Client{
+		Timeout: probeTimeout,
+		// redirects are checked as responses of their own
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	if scheme == "https" {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: true,
+		}
+		client.Transport = transport
+	}
+	return client
+}
+
+// run sends every probe and reports whether all of them passed.
+func (p *prober) run(ctx context.Context, probes []file_config.ProbeConfig) ([]probeResult, bool) {
+	results := make([]probeResult, 0, len(probes))
+	passed := true
+	for _, probe := range probes {
+		result := p.probe(ctx, probe)
+		if !result.Passed {
+			passed = false
+		}
+		results = append(results, result)
+	}
+	return results, passed
+}
+
+func (p *prober) probe(ctx context.Context, probe file_config.ProbeConfig) probeResult {
+	result := probeResult{
+		Path:           probe.Path,
+		Host:           probe.Host,
+		Port:           probe.Port,
+		ExpectedStatus: probe.Status,
+	}
+	if result.Port == 0 {
+		result.Port = p.defaultPort
+	}
+	if result.ExpectedStatus == 0 {
+		result.ExpectedStatus = http.StatusOK
+	}
+
+	if result.Port == 0 {
+		result.Error = "no http or https port mapping to probe, set the probe port"
+		return result
+	}
+	result.Scheme = p.schemes[result.Port]
+	if result.Scheme == "" {
+		result.Scheme = "http"
+	}
+
+	url := fmt.Sprintf("%s://%s%s", result.Scheme, net.JoinHostPort(p.addr, strconv.Itoa(result.Port)), probe.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		result.Error = fmt.Sprintf("invalid probe request: %v", err)
+		return result
+	}
+	req.Host = probe.Host
+
+	client := p.newClient(result.Scheme, probe.Host)
+	defer client.CloseIdleConnections()
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	result.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	result.Status = resp.StatusCode
+	if resp.StatusCode != result.ExpectedStatus {
+		result.Error = fmt.Sprintf("expected status %d, got %d", result.ExpectedStatus, resp.StatusCode)
+		return result
+	}
+
+	if probe.Body != "" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, probeBodyLimit))
+		if err != nil {
+			result.Error = fmt.Sprintf("failed to read body: %v", err)
+			return result
+		}
+		// validated when the config is read
+		bodyRegex := regexp.MustCompile(probe.Body)
+		if !bodyRegex.Match(body) {
+			result.Error = fmt.Sprintf("body does not match %s", probe.Body)
+			return result
+		}
+	}
+
+	result.Passed = true
+	return result
+}
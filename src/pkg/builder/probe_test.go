@@ -0,0 +1,150 @@
+package builder
+
+import (
+	"context"
+	"dokku-nginx-custom/src/pkg/file_config"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestProber(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Host != "api.example.com":
+			w.WriteHeader(http.StatusMisdirectedRequest)
+		case r.URL.Path == "/healthz":
+			fmt.Fprint(w, `{"status":"ok"}`)
+		case r.URL.Path == "/old":
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	host, portStr, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse server address: %v", err)
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	tests := []struct {
+		name   string
+		probe  file_config.ProbeConfig
+		status int
+		errMsg string
+	}{
+		{
+			name:   "Ok",
+			probe:  file_config.ProbeConfig{Path: "/healthz", Host: "api.example.com"},
+			status: http.StatusOK,
+		},
+		{
+			name:   "BodyMatches",
+			probe:  file_config.ProbeConfig{Path: "/healthz", Host: "api.example.com", Body: `"status":\s*"ok"`},
+			status: http.StatusOK,
+		},
+		{
+			name:   "RedirectNotFollowed",
+			probe:  file_config.ProbeConfig{Path: "/old", Host: "api.example.com", Status: http.StatusMovedPermanently},
+			status: http.StatusMovedPermanently,
+		},
+		{
+			name:   "UnexpectedStatus",
+			probe:  file_config.ProbeConfig{Path: "/missing", Host: "api.example.com"},
+			status: http.StatusNotFound,
+			errMsg: "expected status 200, got 404",
+		},
+		{
+			name:   "WrongHost",
+			probe:  file_config.ProbeConfig{Path: "/healthz", Host: "www.example.com"},
+			status: http.StatusMisdirectedRequest,
+			errMsg: "expected status 200, got 421",
+		},
+		{
+			name:   "BodyMismatch",
+			probe:  file_config.ProbeConfig{Path: "/healthz", Host: "api.example.com", Body: "degraded"},
+			status: http.StatusOK,
+			errMsg: "body does not match degraded",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, passed := newProber(host, []PortMapping{{Scheme: "http", ListenPort: portStr, UpstreamPort: "5000"}}).run(context.Background(), []file_config.ProbeConfig{tt.probe})
+			if len(results) != 1 {
+				t.Fatalf("Expected 1 result, got: %v", results)
+			}
+			result := results[0]
+
+			if result.Status != tt.status {
+				t.Errorf("Expected status %d, got: %d", tt.status, result.Status)
+			}
+			if result.Port != port {
+				t.Errorf("Expected default port %d, got: %d", port, result.Port)
+			}
+			if tt.errMsg == "" {
+				if !passed || !result.Passed || result.Error != "" {
+					t.Errorf("Expected probe to pass, got: %+v", result)
+				}
+				return
+			}
+			if passed || result.Passed || !strings.Contains(result.Error, tt.errMsg) {
+				t.Errorf("Expected probe to fail with %q, got: %+v", tt.errMsg, result)
+			}
+		})
+	}
+
+	t.Run("NoPort", func(t *testing.T) {
+		results, passed := newProber(host, nil).run(context.Background(), []file_config.ProbeConfig{{Path: "/healthz", Host: "api.example.com"}})
+		if passed || !strings.Contains(results[0].Error, "no http or https port mapping") {
+			t.Errorf("Expected missing port error, got: %+v", results[0])
+		}
+	})
+
+	t.Run("DefaultProbePort", func(t *testing.T) {
+		portMappings := []PortMapping{
+			{Scheme: "https", ListenPort: "443", UpstreamPort: "5000"},
+			{Scheme: "http", ListenPort: "8080", UpstreamPort: "5000"},
+		}
+		if port := defaultProbePort(portMappings); port != 8080 {
+			t.Errorf("Expected port 8080, got: %d", port)
+		}
+		if port := defaultProbePort(portMappings[:1]); port != 443 {
+			t.Errorf("Expected port 443 without http mapping, got: %d", port)
+		}
+	})
+}
+
+func TestProberTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// nginx picks the server block of an https request by its SNI
+		if r.TLS.ServerName != "api.example.com" || r.Host != "api.example.com" {
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	host, portStr, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse server address: %v", err)
+	}
+	portMappings := []PortMapping{{Scheme: "https", ListenPort: portStr, UpstreamPort: "5000"}}
+
+	results, passed := newProber(host, portMappings).run(context.Background(), []file_config.ProbeConfig{{Path: "/", Host: "api.example.com"}})
+	if !passed || results[0].Scheme != "https" {
+		t.Errorf("Expected probe to pass over https, got: %+v", results[0])
+	}
+
+	results, passed = newProber(host, portMappings).run(context.Background(), []file_config.ProbeConfig{{Path: "/", Host: "www.example.com"}})
+	if passed || results[0].Status != http.StatusMisdirectedRequest {
+		t.Errorf("Expected probe to reach the server with the other SNI, got: %+v", results[0])
+	}
+}
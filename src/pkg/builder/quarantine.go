@@ -0,0 +1,106 @@
+package builder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// failedDirectoryName is the directory under the nginx config directory
+	// failed releases are moved into
+	failedDirectoryName = "failed"
+	failureFilename     = "failure.json"
+	// failedConfigFilename is the copy of the input config of a failed release
+	failedConfigFilename = "source-config.yml"
+	// failedReleaseRetention is the number of latest failed releases kept
+	failedReleaseRetention = 5
+)
+
+// Stages of a build a release can fail at
+const (
+	failureStageNginxTest = "nginx-test"
+	failureStageReload    = "reload"
+	failureStageProbes    = "probes"
+)
+
+// releaseFailure records why a release failed, written into the failed
+// release as failure.json
+type releaseFailure struct {
+	Release  string    `json:"release"`
+	FailedAt time.Time `json:"failed_at"`
+	Stage    string    `json:"stage"`
+	// Error holds the output of the failing command
+	Error string `json:"error"`
+}
+
+func failedReleasesDirectory(nginxConfigDirectory string) string {
+	return path.Join(nginxConfigDirectory, failedDirectoryName)
+}
+
+// quarantineRelease moves a release that failed out of the releases, into
+// failed/ next to them, along with the input config and the failure. Its
+// manifest already records the build env. Only the latest
+// failedReleaseRetention failed releases are kept.
+func quarantineRelease(nginxConfigDirectory string, releaseDir string, configFilePath string, failure releaseFailure) error {
+	failedDir := failedReleasesDirectory(nginxConfigDirectory)
+	if err := os.MkdirAll(failedDir, 0755); err != nil {
+		return fmt.Errorf("failed to create failed releases directory: %w", err)
+	}
+
+	quarantinedDir := path.Join(failedDir, filepath.Base(releaseDir))
+	if err := os.Rename(releaseDir, quarantinedDir); err != nil {
+		return fmt.Errorf("failed to move release to %s: %w", quarantinedDir, err)
+	}
+
+	configContent, err := os.ReadFile(configFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err := copyConfigToRelease(string(configContent), quarantinedDir, failedConfigFilename); err != nil {
+		return err
+	}
+
+	failure.Release = filepath.Base(releaseDir)
+	failure.FailedAt = failure.FailedAt.UTC()
+	content, err := json.MarshalIndent(failure, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode failure: %w", err)
+	}
+	if err := copyConfigToRelease(string(content)+"\n", quarantinedDir, failureFilename); err != nil {
+		return err
+	}
+
+	failed, err := listReleases(failedDir)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(failed)-failedReleaseRetention; i++ {
+		if err := os.RemoveAll(failed[i].Dir); err != nil {
+			return fmt.Errorf("failed to remove failed release %s: %w", failed[i].Dir, err)
+		}
+	}
+
+	return nil
+}
+
+// readReleaseFailure returns the failure recorded in a failed release.
+func readReleaseFailure(failedReleaseDir string) (*releaseFailure, error) {
+	content, err := os.ReadFile(path.Join(failedReleaseDir, failureFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no failure recorded in %s", filepath.Base(failedReleaseDir))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read failure: %w", err)
+	}
+
+	var failure releaseFailure
+	if err := json.Unmarshal(content, &failure); err != nil {
+		return nil, fmt.Errorf("failed to parse failure of %s: %w", filepath.Base(failedReleaseDir), err)
+	}
+	return &failure, nil
+}
@@ -0,0 +1,67 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQuarantineRelease(t *testing.T) {
+	tempDir := t.TempDir()
+	configFilePath := filepath.Join(tempDir, "nginx.yml")
+	if err := os.WriteFile(configFilePath, []byte("vhosts: []\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	nginxConfigDirectory := filepath.Join(tempDir, "conf.d")
+	releaseDirs := []string{
+		"release-20011225.1",
+		"release-20011225.2",
+		"release-20011225.3",
+		"release-20011225.4",
+		"release-20011225.5",
+		"release-20011225.6",
+		"release-20011225.7",
+	}
+	createTestReleases(t, nginxConfigDirectory, releaseDirs...)
+
+	for _, dir := range releaseDirs {
+		failure := releaseFailure{FailedAt: buildTime, Stage: failureStageNginxTest, Error: "nginx: [emerg] unknown directive in " + dir}
+		if err := quarantineRelease(nginxConfigDirectory, filepath.Join(nginxConfigDirectory, dir), configFilePath, failure); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+
+	if remaining := remainingReleases(t, nginxConfigDirectory); len(remaining) != 0 {
+		t.Errorf("Expected failed releases to be moved away, got: %v", remaining)
+	}
+
+	failedDir := failedReleasesDirectory(nginxConfigDirectory)
+	failed := remainingReleases(t, failedDir)
+	if len(failed) != failedReleaseRetention || failed[0] != "release-20011225.3" {
+		t.Fatalf("Expected the latest %d failed releases to be kept, got: %v", failedReleaseRetention, failed)
+	}
+
+	lastDir := filepath.Join(failedDir, "release-20011225.7")
+	content, err := os.ReadFile(filepath.Join(lastDir, failedConfigFilename))
+	if err != nil || string(content) != "vhosts: []\n" {
+		t.Errorf("Expected input config to be kept, got: %q (%v)", content, err)
+	}
+
+	failure, err := readReleaseFailure(lastDir)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if failure.Release != "release-20011225.7" || failure.Stage != failureStageNginxTest || !strings.Contains(failure.Error, "unknown directive") {
+		t.Errorf("Unexpected failure: %+v", failure)
+	}
+
+	next, err := getNextReleaseDirectory(nginxConfigDirectory, buildTime)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if filepath.Base(next) != "release-20011225.8" {
+		t.Errorf("Expected the sequence to continue after failed releases, got: %s", filepath.Base(next))
+	}
+}
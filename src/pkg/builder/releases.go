@@ -0,0 +1,439 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// release is a release-YYYYMMDD.N directory under the nginx config directory
+type release struct {
+	Dir      string
+	Date     int
+	Sequence int
+	// ModTime is the time the release was built
+	ModTime time.Time
+}
+
+var releasePattern = regexp.MustCompile(`^release-(\d{8})\.(\d+)$`)
+
+// listReleases returns the release directories of nginxConfigDirectory,
+// oldest first. Entries not matching the release-YYYYMMDD.N format are
+// ignored, a missing directory has no releases.
+func listReleases(nginxConfigDirectory string) ([]release, error) {
+	files, err := filepath.Glob(path.Join(nginxConfigDirectory, "release-*"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read nginx config directory: %w", err)
+	}
+
+	releases := make([]release, 0, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+
+		matches := releasePattern.FindStringSubmatch(filepath.Base(file))
+		if len(matches) != 3 {
+			continue
+		}
+
+		date, err := strconv.Atoi(matches[1])
+		if err != nil {
+			continue
+		}
+		sequence, err := strconv.Atoi(matches[2])
+		if err != nil {
+			continue
+		}
+
+		releases = append(releases, release{Dir: file, Date: date, Sequence: sequence, ModTime: info.ModTime()})
+	}
+
+	sort.Slice(releases, func(i, j int) bool {
+		if releases[i].Date != releases[j].Date {
+			return releases[i].Date < releases[j].Date
+		}
+		return releases[i].Sequence < releases[j].Sequence
+	})
+
+	return releases, nil
+}
+
+// getNextReleaseDirectory returns the path of a fresh release directory for a
+// build at now. The sequence continues from the day's latest release, failed
+// ones included, and starts over at 1 every day, so no build ever writes
+// into an existing release.
+func getNextReleaseDirectory(nginxConfigDirectory string, now time.Time) (string, error) {
+	releases, err := listReleases(nginxConfigDirectory)
+	if err != nil {
+		return "", err
+	}
+	failed, err := listReleases(failedReleasesDirectory(nginxConfigDirectory))
+	if err != nil {
+		return "", err
+	}
+	releases = append(releases, failed...)
+
+	yyyymmdd := now.Format("20060102")
+	today, err := strconv.Atoi(yyyymmdd)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse release date %s: %w", yyyymmdd, err)
+	}
+
+	sequence := 1
+	for _, r := range releases {
+		if r.Date == today && r.Sequence >= sequence {
+			sequence = r.Sequence + 1
+		}
+	}
+
+	return path.Join(nginxConfigDirectory, fmt.Sprintf("release-%s.%d", yyyymmdd, sequence)), nil
+}
+
+// releaseRetention is the policy deciding which releases survive a prune. A
+// release is kept when it is one of the latest count releases or younger
+// than maxAge. current and the release right before it are always kept.
+type releaseRetention struct {
+	count  int
+	maxAge time.Duration
+}
+
+// ParseRetentionAge parses a release retention age, a Go duration such as
+// 72h or a number of days such as 7d.
+func ParseRetentionAge(value string) (time.Duration, error) {
+	var age time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		age = time.Duration(n) * 24 * time.Hour
+	} else {
+		age, err = time.ParseDuration(value)
+	}
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("invalid retention age %s, expected a duration such as 72h or 7d", value)
+	}
+	return age, nil
+}
+
+// pruneReleases removes the release directories falling out of retention and
+// returns the removed directories.
+func pruneReleases(nginxConfigDirectory string, retention releaseRetention, now time.Time) ([]string, error) {
+	releases, err := listReleases(nginxConfigDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	currentDir, err := getPreviousVersionDirectory(nginxConfigDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	keep := make(map[string]bool)
+	for i, r := range releases {
+		if filepath.Clean(r.Dir) != filepath.Clean(currentDir) {
+			continue
+		}
+		keep[r.Dir] = true
+		if i > 0 {
+			keep[releases[i-1].Dir] = true
+		}
+	}
+
+	for i, r := range releases {
+		if i >= len(releases)-retention.count {
+			keep[r.Dir] = true
+		}
+		if retention.maxAge > 0 && now.Sub(r.ModTime) < retention.maxAge {
+			keep[r.Dir] = true
+		}
+	}
+
+	pruned := make([]string, 0)
+	for _, r := range releases {
+		if keep[r.Dir] {
+			continue
+		}
+		if err := os.RemoveAll(r.Dir); err != nil {
+			return pruned, fmt.Errorf("failed to remove release %s: %w", r.Dir, err)
+		}
+		pruned = append(pruned, r.Dir)
+	}
+
+	return pruned, nil
+}
+
+// releasesCommand holds what the releases subcommands need to act on an
+// app's releases.
+type releasesCommand struct {
+	nginxConfigDirectory string
+	nginxTestCommand     string
+	reloader             *nginxReloader
+	// locks is nil when the command runs without locking
+	locks *buildLocks
+	out   io.Writer
+}
+
+// run dispatches the releases subcommands:
+//
+//	releases list
+//	releases rollback [<release>]
+//	releases diff <from> [<to>]
+//	releases last-failure
+func (c *releasesCommand) run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing releases subcommand, expected one of list, rollback, diff, last-failure")
+	}
+
+	switch args[0] {
+	case "list":
+		return c.list()
+	case "rollback":
+		if len(args) > 2 {
+			return fmt.Errorf("usage: releases rollback [<release>]")
+		}
+		target := ""
+		if len(args) == 2 {
+			target = args[1]
+		}
+		return c.rollback(ctx, target)
+	case "diff":
+		if len(args) < 2 || len(args) > 3 {
+			return fmt.Errorf("usage: releases diff <from> [<to>]")
+		}
+		to := "current"
+		if len(args) == 3 {
+			to = args[2]
+		}
+		return c.diff(ctx, args[1], to)
+	case "last-failure":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: releases last-failure")
+		}
+		return c.lastFailure()
+	default:
+		return fmt.Errorf("unknown releases subcommand %s, expected one of list, rollback, diff, last-failure", args[0])
+	}
+}
+
+// list prints the releases newest first, marking the one current points at.
+func (c *releasesCommand) list() error {
+	releases, err := listReleases(c.nginxConfigDirectory)
+	if err != nil {
+		return err
+	}
+
+	currentDir, err := getPreviousVersionDirectory(c.nginxConfigDirectory)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RELEASE\tBUILT\tGIT REV\tCONFIG SHA256\tBUILDER\tCURRENT")
+	for i := len(releases) - 1; i >= 0; i-- {
+		r := releases[i]
+		current := ""
+		if filepath.Clean(r.Dir) == filepath.Clean(currentDir) {
+			current = "*"
+		}
+
+		builtAt, gitRev, configSha, builderVersion := r.ModTime, "-", "-", "-"
+		manifest, err := readReleaseManifest(r.Dir)
+		if err != nil {
+			return err
+		}
+		if manifest != nil {
+			builtAt, configSha, builderVersion = manifest.BuiltAt, shortHash(manifest.Config.Sha256), manifest.BuilderVersion
+			if manifest.Source.GitRev != "" {
+				gitRev = shortHash(manifest.Source.GitRev)
+			}
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", filepath.Base(r.Dir), builtAt.Format(time.RFC3339), gitRev, configSha, builderVersion, current)
+	}
+	return w.Flush()
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
+
+// resolveRelease returns the directory of the named release, "current"
+// naming the release current points at.
+func (c *releasesCommand) resolveRelease(name string) (string, error) {
+	if name == "current" {
+		currentDir, err := getPreviousVersionDirectory(c.nginxConfigDirectory)
+		if err != nil {
+			return "", err
+		}
+		if currentDir == "" {
+			return "", fmt.Errorf("no current release")
+		}
+		return currentDir, nil
+	}
+
+	releases, err := listReleases(c.nginxConfigDirectory)
+	if err != nil {
+		return "", err
+	}
+	for _, r := range releases {
+		if filepath.Base(r.Dir) == name {
+			return r.Dir, nil
+		}
+	}
+	return "", fmt.Errorf("release %s not found", name)
+}
+
+// rollback points current at the target release, the release right before
+// current when empty. current is restored when the target fails nginx -t or
+// the reload.
+func (c *releasesCommand) rollback(ctx context.Context, target string) error {
+	if c.locks != nil {
+		appLock, err := c.locks.lockApp()
+		if err != nil {
+			return err
+		}
+		defer appLock.release()
+
+		globalLock, err := c.locks.lockGlobal()
+		if err != nil {
+			return err
+		}
+		defer globalLock.release()
+	}
+
+	currentDir, err := getPreviousVersionDirectory(c.nginxConfigDirectory)
+	if err != nil {
+		return err
+	}
+
+	targetDir := ""
+	if target != "" {
+		if targetDir, err = c.resolveRelease(target); err != nil {
+			return err
+		}
+	} else {
+		releases, err := listReleases(c.nginxConfigDirectory)
+		if err != nil {
+			return err
+		}
+		for i, r := range releases {
+			if filepath.Clean(r.Dir) == filepath.Clean(currentDir) && i > 0 {
+				targetDir = releases[i-1].Dir
+			}
+		}
+		if targetDir == "" {
+			return fmt.Errorf("no release before the current one to roll back to")
+		}
+	}
+
+	if filepath.Clean(targetDir) == filepath.Clean(currentDir) {
+		return fmt.Errorf("release %s is already current", filepath.Base(targetDir))
+	}
+
+	if err := updateCurrentSymlink(c.nginxConfigDirectory, targetDir); err != nil {
+		return err
+	}
+
+	if err := testNginxConfig(ctx, c.nginxTestCommand); err != nil {
+		if rollbackErr := rollbackToPrevious(c.nginxConfigDirectory, currentDir); rollbackErr != nil {
+			return fmt.Errorf("failed to restore current release after %v: %w", err, rollbackErr)
+		}
+		return fmt.Errorf("release %s left current unchanged: %w", filepath.Base(targetDir), err)
+	}
+
+	if err := c.reloader.reload(ctx); err != nil {
+		if rollbackErr := rollbackToPrevious(c.nginxConfigDirectory, currentDir); rollbackErr != nil {
+			return fmt.Errorf("failed to restore current release after %v: %w", err, rollbackErr)
+		}
+		if reloadErr := c.reloader.reload(ctx); reloadErr != nil {
+			return fmt.Errorf("failed to reload the restored current release after %v: %w", err, reloadErr)
+		}
+		return fmt.Errorf("release %s left current unchanged: %w", filepath.Base(targetDir), err)
+	}
+
+	fmt.Fprintf(c.out, "rolled back to %s\n", filepath.Base(targetDir))
+	return nil
+}
+
+// diff prints a unified diff of the files of two releases.
+func (c *releasesCommand) diff(ctx context.Context, from string, to string) error {
+	fromDir, err := c.resolveRelease(from)
+	if err != nil {
+		return err
+	}
+	toDir, err := c.resolveRelease(to)
+	if err != nil {
+		return err
+	}
+
+	// relative paths keep the release names in the diff headers
+	cmd := exec.CommandContext(ctx, "diff", "-ruN", filepath.Base(fromDir), filepath.Base(toDir))
+	cmd.Dir = c.nginxConfigDirectory
+	cmd.Stdout = c.out
+	cmd.Stderr = c.out
+	if err := cmd.Run(); err != nil {
+		// diff exits with 1 when the releases differ
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return nil
+		}
+		return fmt.Errorf("failed to diff releases: %w", err)
+	}
+	return nil
+}
+
+// lastFailure prints the latest failed release: why and when it failed, its
+// source, and where its files and input config were kept.
+func (c *releasesCommand) lastFailure() error {
+	failed, err := listReleases(failedReleasesDirectory(c.nginxConfigDirectory))
+	if err != nil {
+		return err
+	}
+	if len(failed) == 0 {
+		fmt.Fprintln(c.out, "no failed releases")
+		return nil
+	}
+
+	failedDir := failed[len(failed)-1].Dir
+	failure, err := readReleaseFailure(failedDir)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Release:\t%s\n", failure.Release)
+	fmt.Fprintf(w, "Failed at:\t%s\n", failure.FailedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "Stage:\t%s\n", failure.Stage)
+	manifest, err := readReleaseManifest(failedDir)
+	if err != nil {
+		return err
+	}
+	if manifest != nil {
+		fmt.Fprintf(w, "Image:\t%s\n", manifest.Source.Image)
+		fmt.Fprintf(w, "Git rev:\t%s\n", manifest.Source.GitRev)
+		fmt.Fprintf(w, "Config:\t%s\n", manifest.Config.Path)
+	}
+	fmt.Fprintf(w, "Files:\t%s\n", failedDir)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.out, "\n%s\n", strings.TrimRight(failure.Error, "\n"))
+	return nil
+}
@@ -0,0 +1,331 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTestReleases creates the release directories, each one an hour
+// younger than the previous one, the last one built an hour before buildTime
+func createTestReleases(t *testing.T, nginxConfigDirectory string, releaseDirs ...string) {
+	t.Helper()
+	for i, dir := range releaseDirs {
+		releaseDir := filepath.Join(nginxConfigDirectory, dir)
+		if err := os.MkdirAll(releaseDir, 0755); err != nil {
+			t.Fatalf("Failed to create test directory %s: %v", dir, err)
+		}
+		builtAt := buildTime.Add(-time.Duration(len(releaseDirs)-i) * time.Hour)
+		if err := os.Chtimes(releaseDir, builtAt, builtAt); err != nil {
+			t.Fatalf("Failed to set times of %s: %v", dir, err)
+		}
+	}
+}
+
+func remainingReleases(t *testing.T, nginxConfigDirectory string) []string {
+	t.Helper()
+	releases, err := listReleases(nginxConfigDirectory)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	names := make([]string, 0, len(releases))
+	for _, r := range releases {
+		names = append(names, filepath.Base(r.Dir))
+	}
+	return names
+}
+
+func TestPruneReleases(t *testing.T) {
+	releaseDirs := []string{
+		"release-20011224.1",
+		"release-20011224.2",
+		"release-20011225.1",
+		"release-20011225.2",
+		"release-20011225.3",
+		"release-20011225.4",
+	}
+
+	tests := []struct {
+		name      string
+		current   string
+		retention releaseRetention
+		expected  []string
+	}{
+		{
+			name:      "KeepLatest",
+			current:   "release-20011225.4",
+			retention: releaseRetention{count: 2},
+			expected:  []string{"release-20011225.3", "release-20011225.4"},
+		},
+		{
+			name:      "KeepCurrentAndPrevious",
+			current:   "release-20011224.2",
+			retention: releaseRetention{count: 1},
+			expected:  []string{"release-20011224.1", "release-20011224.2", "release-20011225.4"},
+		},
+		{
+			name:      "KeepYoungerThanMaxAge",
+			current:   "release-20011225.4",
+			retention: releaseRetention{count: 1, maxAge: 150 * time.Minute},
+			expected:  []string{"release-20011225.3", "release-20011225.4"},
+		},
+		{
+			name:      "KeepAllWithinCount",
+			current:   "release-20011225.4",
+			retention: releaseRetention{count: 10},
+			expected:  releaseDirs,
+		},
+		{
+			name:      "NoCurrent",
+			retention: releaseRetention{count: 0, maxAge: 90 * time.Minute},
+			expected:  []string{"release-20011225.4"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			createTestReleases(t, tempDir, releaseDirs...)
+			if tt.current != "" {
+				if err := os.Symlink(tt.current, filepath.Join(tempDir, "current")); err != nil {
+					t.Fatalf("Failed to create symlink: %v", err)
+				}
+			}
+
+			pruned, err := pruneReleases(tempDir, tt.retention, buildTime)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+
+			remaining := remainingReleases(t, tempDir)
+			if len(remaining) != len(tt.expected) {
+				t.Fatalf("Expected releases %v to remain, got: %v", tt.expected, remaining)
+			}
+			for i := range tt.expected {
+				if remaining[i] != tt.expected[i] {
+					t.Errorf("Expected releases %v to remain, got: %v", tt.expected, remaining)
+					break
+				}
+			}
+
+			if len(pruned)+len(remaining) != len(releaseDirs) {
+				t.Errorf("Expected %d pruned releases, got: %v", len(releaseDirs)-len(remaining), pruned)
+			}
+		})
+	}
+}
+
+func newTestReleasesCommand(t *testing.T, current string, releaseDirs ...string) (*releasesCommand, *strings.Builder) {
+	t.Helper()
+	tempDir := t.TempDir()
+	createTestReleases(t, tempDir, releaseDirs...)
+	for _, dir := range releaseDirs {
+		if err := os.WriteFile(filepath.Join(tempDir, dir, "upstreams.conf"), []byte("# "+dir+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to write config of %s: %v", dir, err)
+		}
+	}
+	if current != "" {
+		if err := os.Symlink(current, filepath.Join(tempDir, "current")); err != nil {
+			t.Fatalf("Failed to create symlink: %v", err)
+		}
+	}
+
+	out := &strings.Builder{}
+	return &releasesCommand{
+		nginxConfigDirectory: tempDir,
+		nginxTestCommand:     "true",
+		reloader:             newNginxReloader("true", "", time.Second),
+		out:                  out,
+	}, out
+}
+
+func currentRelease(t *testing.T, nginxConfigDirectory string) string {
+	t.Helper()
+	target, err := os.Readlink(filepath.Join(nginxConfigDirectory, "current"))
+	if err != nil {
+		t.Fatalf("Failed to read symlink: %v", err)
+	}
+	return target
+}
+
+func TestParseRetentionAge(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"72h":   72 * time.Hour,
+		"1h30m": 90 * time.Minute,
+		"7d":    7 * 24 * time.Hour,
+		"0":     0,
+	} {
+		age, err := ParseRetentionAge(value)
+		if err != nil || age != expected {
+			t.Errorf("Expected %s to parse as %s, got: %s (%v)", value, expected, age, err)
+		}
+	}
+
+	for _, value := range []string{"", "7", "d", "1.5d", "7days", "-1h", "-2d"} {
+		if _, err := ParseRetentionAge(value); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestReleasesCommand(t *testing.T) {
+	releaseDirs := []string{"release-20011224.1", "release-20011225.1", "release-20011225.2"}
+
+	t.Run("List", func(t *testing.T) {
+		cmd, out := newTestReleasesCommand(t, "release-20011225.1", releaseDirs...)
+		if err := cmd.run(context.Background(), []string{"list"}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != 4 {
+			t.Fatalf("Expected a header and 3 releases, got:\n%s", out.String())
+		}
+		if !strings.HasPrefix(lines[1], "release-20011225.2") || !strings.HasPrefix(lines[3], "release-20011224.1") {
+			t.Errorf("Expected releases newest first, got:\n%s", out.String())
+		}
+		if !strings.HasSuffix(lines[2], "*") || strings.HasSuffix(lines[1], "*") {
+			t.Errorf("Expected release-20011225.1 to be marked current, got:\n%s", out.String())
+		}
+	})
+
+	t.Run("ListWithManifest", func(t *testing.T) {
+		cmd, out := newTestReleasesCommand(t, "release-20011225.2", releaseDirs...)
+		manifest := &releaseManifest{
+			App:            "app",
+			BuiltAt:        buildTime,
+			BuilderVersion: "0.1.0",
+			Config:         manifestConfig{Sha256: "aaaabbbbccccddddeeee"},
+			Source:         manifestSource{GitRev: "0123456789abcdef"},
+		}
+		if err := writeReleaseManifest(filepath.Join(cmd.nginxConfigDirectory, "release-20011225.2"), manifest); err != nil {
+			t.Fatalf("Failed to write manifest: %v", err)
+		}
+
+		if err := cmd.run(context.Background(), []string{"list"}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		fields := strings.Fields(strings.Split(out.String(), "\n")[1])
+		expected := []string{"release-20011225.2", "2001-12-25T10:00:00Z", "0123456789ab", "aaaabbbbcccc", "0.1.0", "*"}
+		if strings.Join(fields, " ") != strings.Join(expected, " ") {
+			t.Errorf("Expected %v, got: %v", expected, fields)
+		}
+	})
+
+	t.Run("RollbackToPrevious", func(t *testing.T) {
+		cmd, out := newTestReleasesCommand(t, "release-20011225.2", releaseDirs...)
+		if err := cmd.run(context.Background(), []string{"rollback"}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if current := currentRelease(t, cmd.nginxConfigDirectory); current != "release-20011225.1" {
+			t.Errorf("Expected current to be release-20011225.1, got: %s", current)
+		}
+		if !strings.Contains(out.String(), "rolled back to release-20011225.1") {
+			t.Errorf("Expected rollback message, got: %s", out.String())
+		}
+	})
+
+	t.Run("RollbackToRelease", func(t *testing.T) {
+		cmd, _ := newTestReleasesCommand(t, "release-20011225.2", releaseDirs...)
+		if err := cmd.run(context.Background(), []string{"rollback", "release-20011224.1"}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if current := currentRelease(t, cmd.nginxConfigDirectory); current != "release-20011224.1" {
+			t.Errorf("Expected current to be release-20011224.1, got: %s", current)
+		}
+	})
+
+	t.Run("RollbackFailingTest", func(t *testing.T) {
+		cmd, _ := newTestReleasesCommand(t, "release-20011225.2", releaseDirs...)
+		cmd.nginxTestCommand = "false"
+		if err := cmd.run(context.Background(), []string{"rollback", "release-20011224.1"}); err == nil {
+			t.Fatalf("Expected error for failing nginx test")
+		}
+		if current := currentRelease(t, cmd.nginxConfigDirectory); current != "release-20011225.2" {
+			t.Errorf("Expected current to stay release-20011225.2, got: %s", current)
+		}
+	})
+
+	t.Run("RollbackFailingReload", func(t *testing.T) {
+		cmd, _ := newTestReleasesCommand(t, "release-20011225.2", releaseDirs...)
+		// only the reload of the restored release succeeds
+		marker := filepath.Join(cmd.nginxConfigDirectory, "reloaded")
+		cmd.reloader = newNginxReloader("test -f "+marker+" || { touch "+marker+"; false; }", "", time.Second)
+		if err := cmd.run(context.Background(), []string{"rollback", "release-20011224.1"}); err == nil {
+			t.Fatalf("Expected error for failing reload")
+		}
+		if current := currentRelease(t, cmd.nginxConfigDirectory); current != "release-20011225.2" {
+			t.Errorf("Expected current to stay release-20011225.2, got: %s", current)
+		}
+	})
+
+	t.Run("RollbackUnknownRelease", func(t *testing.T) {
+		cmd, _ := newTestReleasesCommand(t, "release-20011225.2", releaseDirs...)
+		err := cmd.run(context.Background(), []string{"rollback", "release-20011201.1"})
+		if err == nil || !strings.Contains(err.Error(), "release release-20011201.1 not found") {
+			t.Errorf("Expected not found error, got: %v", err)
+		}
+	})
+
+	t.Run("LastFailure", func(t *testing.T) {
+		cmd, out := newTestReleasesCommand(t, "release-20011225.1", releaseDirs...)
+		configFilePath := filepath.Join(cmd.nginxConfigDirectory, "nginx.yml")
+		if err := os.WriteFile(configFilePath, []byte("vhosts: []\n"), 0644); err != nil {
+			t.Fatalf("Failed to write config file: %v", err)
+		}
+		failure := releaseFailure{FailedAt: buildTime, Stage: failureStageReload, Error: "nginx reload failed: signal process started\n"}
+		if err := quarantineRelease(cmd.nginxConfigDirectory, filepath.Join(cmd.nginxConfigDirectory, "release-20011225.2"), configFilePath, failure); err != nil {
+			t.Fatalf("Failed to quarantine release: %v", err)
+		}
+
+		if err := cmd.run(context.Background(), []string{"last-failure"}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		for _, expected := range []string{
+			"Release:    release-20011225.2",
+			"Failed at:  2001-12-25T10:00:00Z",
+			"Stage:      reload",
+			"nginx reload failed: signal process started",
+		} {
+			if !strings.Contains(out.String(), expected) {
+				t.Errorf("Expected output to contain %q, got:\n%s", expected, out.String())
+			}
+		}
+	})
+
+	t.Run("NoFailure", func(t *testing.T) {
+		cmd, out := newTestReleasesCommand(t, "release-20011225.2", releaseDirs...)
+		if err := cmd.run(context.Background(), []string{"last-failure"}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if strings.TrimSpace(out.String()) != "no failed releases" {
+			t.Errorf("Expected no failed releases, got: %s", out.String())
+		}
+	})
+
+	t.Run("Diff", func(t *testing.T) {
+		if _, err := exec.LookPath("diff"); err != nil {
+			t.Skip("diff not available")
+		}
+
+		cmd, out := newTestReleasesCommand(t, "release-20011225.2", releaseDirs...)
+		if err := cmd.run(context.Background(), []string{"diff", "release-20011224.1"}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		for _, expected := range []string{
+			"--- release-20011224.1/upstreams.conf",
+			"+++ release-20011225.2/upstreams.conf",
+			"-# release-20011224.1",
+			"+# release-20011225.2",
+		} {
+			if !strings.Contains(out.String(), expected) {
+				t.Errorf("Expected diff to contain %q, got:\n%s", expected, out.String())
+			}
+		}
+	})
+}
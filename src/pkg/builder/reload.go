@@ -0,0 +1,153 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// nginxReloader reloads nginx and checks the new config went live: the
+// command has to succeed, the master process has to survive and start a new
+// generation of workers. nginx keeps the old workers, and the old config,
+// when it fails to apply a reload.
+type nginxReloader struct {
+	command string
+	// pidFile is the nginx master pid file, only the exit code of the
+	// command is checked when empty
+	pidFile string
+	// timeout bounds the wait for the new worker generation
+	timeout  time.Duration
+	procRoot string
+}
+
+func newNginxReloader(command string, pidFile string, timeout time.Duration) *nginxReloader {
+	return &nginxReloader{
+		command:  command,
+		pidFile:  pidFile,
+		timeout:  timeout,
+		procRoot: "/proc",
+	}
+}
+
+func (r *nginxReloader) reload(ctx context.Context) error {
+	if r.pidFile == "" {
+		return r.runCommand(ctx)
+	}
+
+	masterPid, err := readPidFile(r.pidFile)
+	if err != nil {
+		return err
+	}
+	workersBefore, err := r.workerPids(masterPid)
+	if err != nil {
+		return err
+	}
+
+	if err := r.runCommand(ctx); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(r.timeout)
+	for {
+		// EPERM still means the process exists, the master runs as root
+		if err := syscall.Kill(masterPid, 0); err != nil && !errors.Is(err, syscall.EPERM) {
+			return fmt.Errorf("nginx master pid %d is gone after reload: %w", masterPid, err)
+		}
+
+		workers, err := r.workerPids(masterPid)
+		if err != nil {
+			return err
+		}
+		for pid := range workers {
+			if !workersBefore[pid] {
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("nginx master pid %d started no new workers within %s of the reload, the previous config is still live", masterPid, r.timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+func (r *nginxReloader) runCommand(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", r.command)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nginx reload failed: %s", string(output))
+	}
+	return nil
+}
+
+// workerPids returns the pids of the child processes of the master.
+func (r *nginxReloader) workerPids(masterPid int) (map[int]bool, error) {
+	stats, err := filepath.Glob(filepath.Join(r.procRoot, "[0-9]*", "stat"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list processes: %w", err)
+	}
+
+	workers := make(map[int]bool)
+	for _, stat := range stats {
+		content, err := os.ReadFile(stat)
+		if err != nil {
+			// the process exited in the meantime
+			continue
+		}
+		pid, ppid, ok := parseProcStat(string(content))
+		if ok && ppid == masterPid {
+			workers[pid] = true
+		}
+	}
+	return workers, nil
+}
+
+// parseProcStat returns the pid and parent pid of a /proc/<pid>/stat line.
+// The command name is parenthesized and may itself contain spaces and
+// parentheses, so fields are read after its last closing parenthesis.
+func parseProcStat(stat string) (int, int, bool) {
+	open := strings.IndexByte(stat, '(')
+	end := strings.LastIndexByte(stat, ')')
+	if open < 0 || end < open {
+		return 0, 0, false
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(stat[:open]))
+	if err != nil {
+		return 0, 0, false
+	}
+
+	// state then ppid
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 2 {
+		return 0, 0, false
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	return pid, ppid, true
+}
+
+func readPidFile(pidFile string) (int, error) {
+	content, err := os.ReadFile(pidFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read nginx pid file: %w", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse nginx pid file %s: %w", pidFile, err)
+	}
+	return pid, nil
+}
@@ -0,0 +1,100 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseProcStat(t *testing.T) {
+	tests := []struct {
+		stat string
+		pid  int
+		ppid int
+		ok   bool
+	}{
+		{stat: "1234 (nginx) S 1000 1000 1000 0 -1", pid: 1234, ppid: 1000, ok: true},
+		{stat: "1235 (nginx: worker (x) process) S 1000 1000", pid: 1235, ppid: 1000, ok: true},
+		{stat: "1236 nginx S 1000", ok: false},
+		{stat: "1237 (nginx) S", ok: false},
+	}
+
+	for _, tt := range tests {
+		pid, ppid, ok := parseProcStat(tt.stat)
+		if ok != tt.ok || pid != tt.pid || ppid != tt.ppid {
+			t.Errorf("parseProcStat(%q) = %d, %d, %v, expected %d, %d, %v", tt.stat, pid, ppid, ok, tt.pid, tt.ppid, tt.ok)
+		}
+	}
+}
+
+// newTestReloader fakes an nginx master, the test process itself so that it
+// is alive, with one worker in a temporary /proc
+func newTestReloader(t *testing.T, command string) *nginxReloader {
+	t.Helper()
+	tempDir := t.TempDir()
+	masterPid := os.Getpid()
+
+	pidFile := filepath.Join(tempDir, "nginx.pid")
+	if err := os.WriteFile(pidFile, []byte(fmt.Sprintf("%d\n", masterPid)), 0644); err != nil {
+		t.Fatalf("Failed to write pid file: %v", err)
+	}
+
+	procRoot := filepath.Join(tempDir, "proc")
+	writeTestProcStat(t, procRoot, 900001, masterPid)
+
+	reloader := newNginxReloader(command, pidFile, 500*time.Millisecond)
+	reloader.procRoot = procRoot
+	return reloader
+}
+
+func writeTestProcStat(t *testing.T, procRoot string, pid int, ppid int) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(procRoot, fmt.Sprint(pid)), 0755); err != nil {
+		t.Fatalf("Failed to create proc directory: %v", err)
+	}
+	stat := fmt.Sprintf("%d (nginx) S %d 0 0 0 -1\n", pid, ppid)
+	if err := os.WriteFile(filepath.Join(procRoot, fmt.Sprint(pid), "stat"), []byte(stat), 0644); err != nil {
+		t.Fatalf("Failed to write stat: %v", err)
+	}
+}
+
+func TestNginxReloader(t *testing.T) {
+	t.Run("NewWorkerGeneration", func(t *testing.T) {
+		reloader := newTestReloader(t, "")
+		// the reload starts a new worker
+		reloader.command = fmt.Sprintf("mkdir -p %[1]s/900002 && echo '900002 (nginx) S %[2]d 0' > %[1]s/900002/stat", reloader.procRoot, os.Getpid())
+
+		if err := reloader.reload(context.Background()); err != nil {
+			t.Errorf("Expected no error, got: %v", err)
+		}
+	})
+
+	t.Run("NoNewWorkers", func(t *testing.T) {
+		reloader := newTestReloader(t, "true")
+
+		err := reloader.reload(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "started no new workers") {
+			t.Errorf("Expected no new workers error, got: %v", err)
+		}
+	})
+
+	t.Run("CommandFails", func(t *testing.T) {
+		reloader := newTestReloader(t, "echo 'bind() failed' && false")
+
+		err := reloader.reload(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "bind() failed") {
+			t.Errorf("Expected command output in error, got: %v", err)
+		}
+	})
+
+	t.Run("WithoutPidFile", func(t *testing.T) {
+		reloader := newNginxReloader("true", "", time.Second)
+		if err := reloader.reload(context.Background()); err != nil {
+			t.Errorf("Expected no error, got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package builder
+
+import (
+	"context"
+	"dokku-nginx-custom/src/pkg/file_config"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CacheContext are the cache defaults of a render context
+type CacheContext struct {
+	OnDiskRootPath string            `yaml:"on_disk_root_path" json:"on_disk_root_path"`
+	InMemRootPath  string            `yaml:"in_mem_root_path" json:"in_mem_root_path"`
+	DefaultFlags   map[string]string `yaml:"default_flags" json:"default_flags"`
+	KeyZoneSize    string            `yaml:"key_zone_size" json:"key_zone_size"`
+}
+
+// RenderContext holds the build inputs Dokku passes through the environment,
+// so that a config can be rendered outside of a Dokku host. It is read from
+// a YAML or JSON file.
+type RenderContext struct {
+	App string `yaml:"app" json:"app"`
+	// ProxyUpstreamPorts are the container ports of the default upstreams,
+	// as in PROXY_UPSTREAM_PORTS
+	ProxyUpstreamPorts []string `yaml:"proxy_upstream_ports" json:"proxy_upstream_ports"`
+	// Listeners are the app's running containers of every process type, as
+	// in DOKKU_APP_LISTENERS_JSON
+	Listeners []Listener `yaml:"listeners" json:"listeners"`
+	// UpstreamAppListeners are the web listeners of the apps referenced by
+	// `app:` upstreams, keyed by app name
+	UpstreamAppListeners map[string][]Listener `yaml:"upstream_app_listeners" json:"upstream_app_listeners"`
+	// PortMap holds scheme:listen:upstream entries, as in PROXY_PORT_MAP
+	PortMap             []string     `yaml:"port_map" json:"port_map"`
+	SSLPath             string       `yaml:"ssl_path" json:"ssl_path"`
+	ErrorPagesDirectory string       `yaml:"error_pages_directory" json:"error_pages_directory"`
+	ProxyCache          CacheContext `yaml:"proxy_cache" json:"proxy_cache"`
+	FastcgiCache        CacheContext `yaml:"fastcgi_cache" json:"fastcgi_cache"`
+}
+
+// ReadRenderContext reads a render context file, JSON being read as YAML.
+func ReadRenderContext(contextFilePath string) (*RenderContext, error) {
+	content, err := os.ReadFile(contextFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read context file: %w", err)
+	}
+
+	var renderCtx RenderContext
+	if err := yaml.Unmarshal(content, &renderCtx); err != nil {
+		return nil, fmt.Errorf("failed to parse context file: %w", err)
+	}
+	if renderCtx.App == "" {
+		return nil, fmt.Errorf("context file %s has no app", contextFilePath)
+	}
+	return &renderCtx, nil
+}
+
+// Options returns the build options of the context for the config at
+// configFilePath.
+func (c *RenderContext) Options(configFilePath string) (Options, error) {
+	processListeners, err := groupListeners(c.Listeners)
+	if err != nil {
+		return Options{}, err
+	}
+
+	portMappings, err := ParsePortMap(strings.Join(c.PortMap, " "))
+	if err != nil {
+		return Options{}, err
+	}
+
+	return Options{
+		AppName:              c.App,
+		ConfigFilePath:       configFilePath,
+		ErrorPagesDirectory:  c.ErrorPagesDirectory,
+		ProxyUpstreamPorts:   c.ProxyUpstreamPorts,
+		AppListeners:         processListeners["web"],
+		ProcessListeners:     processListeners,
+		UpstreamAppListeners: c.UpstreamAppListeners,
+		PortMappings:         portMappings,
+		SSLPath:              c.SSLPath,
+		ProxyCache:           CacheOptions(c.ProxyCache),
+		FastcgiCache:         CacheOptions(c.FastcgiCache),
+	}, nil
+}
+
+// Render renders the config of opts into outputDir, without releases:
+// current, nginx and the app's data directory are left alone. Files of an
+// earlier render are overwritten, the files it has and this one does not
+// are left in place.
+func Render(ctx context.Context, opts Options, outputDir string) (*Result, error) {
+	if err := opts.checkRequired("AppName", "ConfigFilePath"); err != nil {
+		return nil, err
+	}
+
+	cfg, _, err := file_config.ReadConfig(opts.ConfigFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file: %w", err)
+	}
+
+	if err := file_config.ResolveLocationIncludes(opts.ConfigFilePath, cfg); err != nil {
+		return nil, fmt.Errorf("error resolving location includes: %w", err)
+	}
+
+	configFiles, result, err := render(opts, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	for filename, content := range configFiles {
+		if err := copyConfigToRelease(content, outputDir, filename); err != nil {
+			return nil, fmt.Errorf("failed to write config file: %w", err)
+		}
+	}
+	result.Release = outputDir
+
+	return result, nil
+}
@@ -0,0 +1,98 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		context  string
+	}{
+		{
+			name:     "YAML",
+			filename: "context.yml",
+			context: `app: app
+proxy_upstream_ports: ["5000"]
+listeners:
+  - ip: 172.17.0.2
+    process_type: web
+    container_index: 1
+port_map: ["http:80:5000"]
+`,
+		},
+		{
+			name:     "JSON",
+			filename: "context.json",
+			context:  `{"app": "app", "proxy_upstream_ports": ["5000"], "listeners": [{"ip": "172.17.0.2", "process_type": "web", "container_index": 1}], "port_map": ["http:80:5000"]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			contextFilePath := filepath.Join(tempDir, tt.filename)
+			if err := os.WriteFile(contextFilePath, []byte(tt.context), 0644); err != nil {
+				t.Fatalf("Failed to write context file: %v", err)
+			}
+			configFilePath := filepath.Join(tempDir, "nginx.yml")
+			if err := os.WriteFile(configFilePath, []byte(testBuildConfig), 0644); err != nil {
+				t.Fatalf("Failed to write config file: %v", err)
+			}
+
+			renderCtx, err := ReadRenderContext(contextFilePath)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			opts, err := renderCtx.Options(configFilePath)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+
+			outputDir := filepath.Join(tempDir, "out")
+			result, err := Render(context.Background(), opts, outputDir)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			if len(result.Warnings) != 0 {
+				t.Errorf("Expected no warnings, got: %v", result.Warnings)
+			}
+
+			vhostConf, err := os.ReadFile(filepath.Join(outputDir, "vhosts/api.example.com/vhost.conf"))
+			if err != nil {
+				t.Fatalf("Failed to read vhost config: %v", err)
+			}
+			if !strings.Contains(string(vhostConf), "proxy_pass http://app-5000;") {
+				t.Errorf("Expected vhost config to proxy to app-5000, got:\n%s", vhostConf)
+			}
+			if !strings.Contains(string(vhostConf), "listen 80;") {
+				t.Errorf("Expected vhost config to listen on 80, got:\n%s", vhostConf)
+			}
+
+			entries, err := os.ReadDir(tempDir)
+			if err != nil {
+				t.Fatalf("Failed to read temp dir: %v", err)
+			}
+			for _, entry := range entries {
+				if strings.HasPrefix(entry.Name(), "app-") || entry.Name() == "current" {
+					t.Errorf("Expected no release data outside the output dir, got: %s", entry.Name())
+				}
+			}
+		})
+	}
+
+	t.Run("MissingApp", func(t *testing.T) {
+		contextFilePath := filepath.Join(t.TempDir(), "context.yml")
+		if err := os.WriteFile(contextFilePath, []byte("proxy_upstream_ports: [\"5000\"]\n"), 0644); err != nil {
+			t.Fatalf("Failed to write context file: %v", err)
+		}
+		if _, err := ReadRenderContext(contextFilePath); err == nil || !strings.Contains(err.Error(), "has no app") {
+			t.Errorf("Expected missing app error, got: %v", err)
+		}
+	})
+}
@@ -6,8 +6,12 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
+	"net"
+	"net/netip"
 	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -19,23 +23,78 @@ import (
 )
 
 type UpstreamServer struct {
-	Addr  string            `yaml:"addr" validate:"required" json:"addr"`
-	Flags map[string]string `yaml:"flags" validate:"required" json:"flags"`
+	Addr  string            `yaml:"addr" validate:"required,upstream_addr" json:"addr"`
+	Flags map[string]string `yaml:"flags" validate:"omitempty" json:"flags"`
 }
 
+// UpstreamServerFlags applies flags to the servers matching every criterion
+// set, or to all servers when none is set
 type UpstreamServerFlags struct {
-	Selector string            `yaml:"selector" validate:"required" json:"selector"`
-	Flags    map[string]string `yaml:"flags" validate:"required" json:"flags"`
+	// Selector is a regex on the server address
+	Selector string `yaml:"selector" json:"selector"`
+	// ContainerIndex matches Dokku's 1-based container index
+	ContainerIndex int `yaml:"container_index" validate:"omitempty,min=1" json:"container_index"`
+	// ContainerName is a glob on the container name, e.g. app.web.*
+	ContainerName string `yaml:"container_name" json:"container_name"`
+	ProcessType   string `yaml:"process_type" json:"process_type"`
+
+	Flags map[string]string `yaml:"flags" validate:"required" json:"flags"`
+}
+
+type UpstreamHash struct {
+	Key        string `yaml:"key" validate:"required" json:"key"`
+	Consistent bool   `yaml:"consistent" json:"consistent"`
+}
+
+type UpstreamRandom struct {
+	Two    bool   `yaml:"two" json:"two"`
+	Method string `yaml:"method" validate:"omitempty,excluded_without=Two,oneof=least_conn least_time=header least_time=last_byte" json:"method"`
+}
+
+type UpstreamKeepalive struct {
+	Connections int    `yaml:"connections" validate:"required,min=1" json:"connections"`
+	Timeout     string `yaml:"timeout" json:"timeout"`
+	Requests    int    `yaml:"requests" validate:"omitempty,min=1" json:"requests"`
+}
+
+// UpstreamSticky pins clients to a server by consistent hashing on one of a
+// cookie, a request header or the client address
+type UpstreamSticky struct {
+	Cookie   string `yaml:"cookie" validate:"required_without_all=Header ClientIp,excluded_with=Header ClientIp,omitempty,variable_name" json:"cookie"`
+	Header   string `yaml:"header" validate:"excluded_with=Cookie ClientIp,omitempty,header_name" json:"header"`
+	ClientIp bool   `yaml:"client_ip" validate:"excluded_with=Cookie Header" json:"client_ip"`
 }
 
 type UpstreamConfig struct {
 	// Select and Name are mutually exclusive
 	SelectDefault       bool                  `yaml:"select_default" validate:"excluded_with=Name,excluded_with=Servers" json:"select_default"`
 	SelectDefaultPort   int                   `yaml:"select_default_port" validate:"excluded_without=SelectDefault" json:"select_default_port"`
-	DefaultServersFlags []UpstreamServerFlags `yaml:"default_servers_flags" validate:"required_if=SelectDefault true" json:"default_servers_flags"`
-
-	Name    string           `yaml:"name" validate:"required_if=SelectDefault false" json:"name"`
-	Servers []UpstreamServer `yaml:"servers" validate:"required_if=Name true,excluded_with=Select" json:"servers"`
+	DefaultServersFlags []UpstreamServerFlags `yaml:"default_servers_flags" validate:"omitempty,dive" json:"default_servers_flags"`
+
+	// SelectProcess generates an upstream for the app's containers of a
+	// process type other than web, named after the process type
+	SelectProcess     string `yaml:"select_process" validate:"omitempty,excluded_with=SelectDefault Name" json:"select_process"`
+	SelectProcessPort int    `yaml:"select_process_port" validate:"required_with=SelectProcess,excluded_without=SelectProcess,max=65535" json:"select_process_port"`
+
+	Name    string           `yaml:"name" validate:"required_without_all=SelectDefault SelectProcess" json:"name"`
+	Servers []UpstreamServer `yaml:"servers" validate:"required_if=Name true,excluded_with=Select,dive" json:"servers"`
+
+	// App points the upstream at the web listeners of another Dokku app
+	App  string `yaml:"app" validate:"omitempty,excluded_with=Servers SelectDefault" json:"app"`
+	Port int    `yaml:"port" validate:"required_with=App,excluded_without=App" json:"port"`
+
+	// Load-balancing methods are mutually exclusive, round-robin is used when
+	// none is set
+	LeastConn bool            `yaml:"least_conn" validate:"excluded_with=IpHash Hash Random Sticky" json:"least_conn"`
+	IpHash    bool            `yaml:"ip_hash" validate:"excluded_with=LeastConn Hash Random Sticky" json:"ip_hash"`
+	Hash      *UpstreamHash   `yaml:"hash" validate:"omitempty,excluded_with=LeastConn IpHash Random Sticky" json:"hash"`
+	Random    *UpstreamRandom `yaml:"random" validate:"omitempty,excluded_with=LeastConn IpHash Hash Sticky" json:"random"`
+	// Sticky is a preset for the hash method
+	Sticky *UpstreamSticky `yaml:"sticky" validate:"omitempty,excluded_with=LeastConn IpHash Hash Random" json:"sticky"`
+
+	Keepalive *UpstreamKeepalive `yaml:"keepalive" validate:"omitempty" json:"keepalive"`
+	// Zone is the size of the shared memory zone, named after the upstream
+	Zone string `yaml:"zone" json:"zone"`
 }
 
 type LocationConfig struct {
@@ -67,6 +126,9 @@ type CacheConfig struct {
 }
 
 type VhostConfig struct {
+	// Existing vhosts are served by a server block managed elsewhere, only
+	// their location fragments are generated
+	Existing   bool             `yaml:"existing" json:"existing"`
 	ServerName string           `yaml:"server_name" validate:"required" json:"server_name"`
 	Locations  []LocationConfig `yaml:"locations" validate:"required,dive" json:"locations"`
 	Variables  []VariableConfig `yaml:"variables" validate:"omitempty,dive" json:"variables"`
@@ -76,9 +138,25 @@ type VhostConfig struct {
 
 type ConfigVars map[string]any
 
+// ProbeConfig is an HTTP request sent to the local nginx after a reload to
+// check the new config routes as expected
+type ProbeConfig struct {
+	Path string `yaml:"path" validate:"required,startswith=/" json:"path"`
+	Host string `yaml:"host" validate:"required" json:"host"`
+	// Port defaults to the listen port of the app's first http port mapping,
+	// or of its first https one when it has no http mapping
+	Port int `yaml:"port" validate:"omitempty,min=1,max=65535" json:"port"`
+	// Status is the expected response status, 200 when unset
+	Status int `yaml:"status" validate:"omitempty,min=100,max=599" json:"status"`
+	// Body is a regex the response body has to match
+	Body string `yaml:"body" validate:"omitempty,regexp" json:"body"`
+}
+
 type Config struct {
 	Vhosts []VhostConfig `yaml:"vhosts" validate:"required,dive"`
 
+	Probes []ProbeConfig `yaml:"probes" validate:"omitempty,dive" json:"probes"`
+
 	UserVars ConfigVars `yaml:"user_vars" validate:"omitempty" json:"vars"`
 
 	Upstreams     []UpstreamConfig `yaml:"upstreams" validate:"omitempty,dive" json:"upstreams"`
@@ -89,6 +167,11 @@ type Config struct {
 	InHttpBlock string `yaml:"in_http_block" validate:"omitempty" json:"in_http_block"`
 }
 
+var (
+	variableNameRegex = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+	headerNameRegex   = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
 func registerValidations(validate *validator.Validate) {
 	// validate.RegisterValidation("excluded_with", func(fl validator.FieldLevel) bool {
 	// 	field := fl.Field()
@@ -99,9 +182,79 @@ func registerValidations(validate *validator.Validate) {
 	// 	other := fl.Parent().FieldByName(fl.Param())
 	// 	return other.IsZero()
 	// })
+
+	validate.RegisterValidation("upstream_addr", func(fl validator.FieldLevel) bool {
+		_, err := NormalizeUpstreamAddr(fl.Field().String())
+		return err == nil
+	})
+
+	validate.RegisterValidation("regexp", func(fl validator.FieldLevel) bool {
+		_, err := regexp.Compile(fl.Field().String())
+		return err == nil
+	})
+
+	// names that end up in nginx variables, e.g. $cookie_<name>
+	validate.RegisterValidation("variable_name", func(fl validator.FieldLevel) bool {
+		return variableNameRegex.MatchString(fl.Field().String())
+	})
+
+	// header names map to $http_<name>, dashes becoming underscores
+	validate.RegisterValidation("header_name", func(fl validator.FieldLevel) bool {
+		return headerNameRegex.MatchString(fl.Field().String())
+	})
+}
+
+// NormalizeUpstreamAddr validates an upstream server address and returns it in
+// canonical form. Accepted are unix:/path sockets, host:port, [ipv6]:port and
+// bare hosts, with IP literals rewritten to their canonical text.
+func NormalizeUpstreamAddr(addr string) (string, error) {
+	if socketPath, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if !filepath.IsAbs(socketPath) {
+			return "", fmt.Errorf("unix socket %s must be an absolute path", addr)
+		}
+		return addr, nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// nginx defaults to port 80 when none is given
+		host, port = addr, ""
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		} else if strings.Contains(host, ":") {
+			return "", fmt.Errorf("invalid upstream address %s: ipv6 addresses must be bracketed", addr)
+		}
+	}
+
+	if host == "" {
+		return "", fmt.Errorf("invalid upstream address %s: missing host", addr)
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		host = ip.String()
+	} else if strings.ContainsAny(host, ":/ ") {
+		return "", fmt.Errorf("invalid upstream address %s", addr)
+	}
+
+	if port == "" {
+		if strings.Contains(host, ":") {
+			return fmt.Sprintf("[%s]", host), nil
+		}
+		return host, nil
+	}
+
+	if portNum, err := strconv.Atoi(port); err != nil || portNum < 1 || portNum > 65535 {
+		return "", fmt.Errorf("invalid upstream address %s: bad port %s", addr, port)
+	}
+
+	return net.JoinHostPort(host, port), nil
 }
 
 func validateConfig(config *Config) error {
+	return validateStruct(config)
+}
+
+func validateStruct(s any) error {
 	validate := validator.New()
 	registerValidations(validate)
 
@@ -114,7 +267,7 @@ func validateConfig(config *Config) error {
 		return name
 	})
 
-	err := validate.Struct(config)
+	err := validate.Struct(s)
 	if err != nil {
 		if _, ok := err.(*validator.InvalidValidationError); ok {
 			return fmt.Errorf("internal validation error: %v", err)
@@ -126,7 +279,7 @@ func validateConfig(config *Config) error {
 			namespace := err.Namespace()
 
 			// Split the namespace into parts
-			parts := strings.Split(strings.TrimPrefix(namespace, "Config."), ".")
+			parts := strings.Split(namespace[strings.Index(namespace, ".")+1:], ".")
 			var pathParts []string
 
 			for i, part := range parts {
@@ -160,6 +313,18 @@ func validateConfig(config *Config) error {
 				msg = fmt.Sprintf("field '%s' must have at least %s items", err.Field(), err.Param())
 			case "required_if":
 				msg = fmt.Sprintf("field '%s' is required when %s", err.Field(), err.Param())
+			case "required_without_all":
+				msg = fmt.Sprintf("field '%s' is required when none of '%s' is provided", err.Field(), err.Param())
+			case "variable_name":
+				msg = fmt.Sprintf("field '%s' may only contain letters, digits and underscores, got '%v'", err.Field(), err.Value())
+			case "header_name":
+				msg = fmt.Sprintf("field '%s' may only contain letters, digits, dashes and underscores, got '%v'", err.Field(), err.Value())
+			case "startswith":
+				msg = fmt.Sprintf("field '%s' must start with '%s', got '%v'", err.Field(), err.Param(), err.Value())
+			case "regexp":
+				msg = fmt.Sprintf("field '%s' must be a valid regular expression, got '%v'", err.Field(), err.Value())
+			case "upstream_addr":
+				msg = fmt.Sprintf("field '%s' must be host:port, [ipv6]:port or unix:/path, got '%v'", err.Field(), err.Value())
 			default:
 				msg = fmt.Sprintf("field '%s' failed validation: %s", err.Field(), err.Tag())
 			}
@@ -260,6 +425,10 @@ func buildGlobalTemplateData(config *Config, tmplData map[string]any) map[string
 	tmplData["named_locations"] = map[string]any{}
 
 	for _, upstream := range config.Upstreams {
+		if upstream.SelectProcess != "" {
+			(tmplData["upstreams"].(map[string]any))[upstream.SelectProcess] = upstream.SelectProcess
+			continue
+		}
 		(tmplData["upstreams"].(map[string]any))[upstream.Name] = upstream.Name
 	}
 
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"html/template"
 	"os"
+	"strings"
 	"testing"
 
 	"gopkg.in/yaml.v3"
@@ -20,6 +21,10 @@ func TestResolveConfigReferences(t *testing.T) {
 		t.Fatalf("Failed to parse YAML: %v", err)
 	}
 
+	if err := ResolveLocationIncludes("testdata/example.yaml", &config); err != nil {
+		t.Fatalf("Failed to resolve location includes: %v", err)
+	}
+
 	var rawConfig interface{}
 	if err := yaml.Unmarshal(fileContent, &rawConfig); err != nil {
 		t.Fatalf("Failed to parse YAML into config struct: %v", err)
@@ -39,3 +44,214 @@ func TestResolveConfigReferences(t *testing.T) {
 	}
 	fmt.Println(rawConfig)
 }
+
+func TestValidateUpstreamMethods(t *testing.T) {
+	base := func() *Config {
+		return &Config{
+			Vhosts: []VhostConfig{
+				{ServerName: "api.example.com", Locations: []LocationConfig{{Uri: "/", Body: "return 200;"}}},
+			},
+		}
+	}
+
+	valid := base()
+	valid.Upstreams = []UpstreamConfig{
+		{
+			Name:      "api",
+			Servers:   []UpstreamServer{{Addr: "127.0.0.1:8001", Flags: map[string]string{}}},
+			Random:    &UpstreamRandom{Two: true, Method: "least_conn"},
+			Keepalive: &UpstreamKeepalive{Connections: 16},
+		},
+	}
+	if err := validateConfig(valid); err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+
+	conflicting := base()
+	conflicting.Upstreams = []UpstreamConfig{
+		{
+			Name:      "api",
+			Servers:   []UpstreamServer{{Addr: "127.0.0.1:8001", Flags: map[string]string{}}},
+			LeastConn: true,
+			Hash:      &UpstreamHash{Key: "$remote_addr"},
+		},
+	}
+	err := validateConfig(conflicting)
+	if err == nil {
+		t.Fatalf("Expected error for conflicting load-balancing methods")
+	}
+	if !strings.Contains(err.Error(), "cannot be used together with") {
+		t.Errorf("Expected mutual exclusion error, got: %v", err)
+	}
+}
+
+func TestValidateUpstreamSticky(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream UpstreamConfig
+		errMsg   string
+	}{
+		{
+			name:     "Cookie",
+			upstream: UpstreamConfig{SelectDefault: true, Sticky: &UpstreamSticky{Cookie: "sessionid"}},
+		},
+		{
+			name:     "Header",
+			upstream: UpstreamConfig{SelectDefault: true, Sticky: &UpstreamSticky{Header: "X-Tenant-Id"}},
+		},
+		{
+			name:     "Empty",
+			upstream: UpstreamConfig{SelectDefault: true, Sticky: &UpstreamSticky{}},
+			errMsg:   "field 'cookie' is required when none of 'Header ClientIp' is provided",
+		},
+		{
+			name:     "CookieAndClientIp",
+			upstream: UpstreamConfig{SelectDefault: true, Sticky: &UpstreamSticky{Cookie: "sessionid", ClientIp: true}},
+			errMsg:   "field 'cookie' cannot be used together with 'Header ClientIp'",
+		},
+		{
+			name:     "InvalidCookieName",
+			upstream: UpstreamConfig{SelectDefault: true, Sticky: &UpstreamSticky{Cookie: "session-id"}},
+			errMsg:   "field 'cookie' may only contain letters, digits and underscores",
+		},
+		{
+			name:     "ConflictingMethod",
+			upstream: UpstreamConfig{SelectDefault: true, LeastConn: true, Sticky: &UpstreamSticky{ClientIp: true}},
+			errMsg:   "field 'sticky' cannot be used together with 'LeastConn IpHash Hash Random'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateConfig(&Config{
+				Vhosts: []VhostConfig{
+					{ServerName: "api.example.com", Locations: []LocationConfig{{Uri: "/", Body: "return 200;"}}},
+				},
+				Upstreams: []UpstreamConfig{tt.upstream},
+			})
+			if tt.errMsg == "" {
+				if err != nil {
+					t.Errorf("Expected no error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("Expected error to contain %q, got: %v", tt.errMsg, err)
+			}
+		})
+	}
+}
+
+func TestValidateProbes(t *testing.T) {
+	tests := []struct {
+		name   string
+		probe  ProbeConfig
+		errMsg string
+	}{
+		{
+			name:  "Minimal",
+			probe: ProbeConfig{Path: "/healthz", Host: "api.example.com"},
+		},
+		{
+			name:  "Full",
+			probe: ProbeConfig{Path: "/", Host: "api.example.com", Port: 8080, Status: 301, Body: "^Moved"},
+		},
+		{
+			name:   "MissingHost",
+			probe:  ProbeConfig{Path: "/healthz"},
+			errMsg: "field 'host' is required",
+		},
+		{
+			name:   "RelativePath",
+			probe:  ProbeConfig{Path: "healthz", Host: "api.example.com"},
+			errMsg: "field 'path' must start with '/'",
+		},
+		{
+			name:   "InvalidStatus",
+			probe:  ProbeConfig{Path: "/healthz", Host: "api.example.com", Status: 42},
+			errMsg: "field 'status'",
+		},
+		{
+			name:   "InvalidBodyRegex",
+			probe:  ProbeConfig{Path: "/healthz", Host: "api.example.com", Body: "ok("},
+			errMsg: "field 'body' must be a valid regular expression",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateConfig(&Config{
+				Vhosts: []VhostConfig{
+					{ServerName: "api.example.com", Locations: []LocationConfig{{Uri: "/", Body: "return 200;"}}},
+				},
+				Probes: []ProbeConfig{tt.probe},
+			})
+			if tt.errMsg == "" {
+				if err != nil {
+					t.Errorf("Expected no error, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("Expected error to contain %q, got: %v", tt.errMsg, err)
+			}
+		})
+	}
+}
+
+func TestNormalizeUpstreamAddr(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected string
+		wantErr  bool
+	}{
+		{addr: "127.0.0.1:8001", expected: "127.0.0.1:8001"},
+		{addr: "[fd00::5]:5000", expected: "[fd00::5]:5000"},
+		{addr: "[FD00:0:0::5]:5000", expected: "[fd00::5]:5000"},
+		{addr: "[::1]", expected: "[::1]"},
+		{addr: "backend.internal:3000", expected: "backend.internal:3000"},
+		{addr: "backend.internal", expected: "backend.internal"},
+		{addr: "unix:/var/run/php/php8.1-fpm.sock", expected: "unix:/var/run/php/php8.1-fpm.sock"},
+		{addr: "unix:relative.sock", wantErr: true},
+		{addr: "fd00::5", wantErr: true},
+		{addr: "127.0.0.1:0", wantErr: true},
+		{addr: "127.0.0.1:http", wantErr: true},
+		{addr: ":5000", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		result, err := NormalizeUpstreamAddr(tt.addr)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got: %s", tt.addr, result)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected no error, got: %v", tt.addr, err)
+			continue
+		}
+		if result != tt.expected {
+			t.Errorf("%s: expected %s, got: %s", tt.addr, tt.expected, result)
+		}
+	}
+}
+
+func TestValidateUpstreamSelectProcess(t *testing.T) {
+	cfg := &Config{
+		Vhosts: []VhostConfig{
+			{ServerName: "api.example.com", Locations: []LocationConfig{{Uri: "/", Body: "return 200;"}}},
+		},
+		Upstreams: []UpstreamConfig{
+			{SelectProcess: "ws", SelectProcessPort: 8080},
+		},
+	}
+	if err := validateConfig(cfg); err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+
+	cfg.Upstreams = []UpstreamConfig{{SelectProcess: "ws"}}
+	if err := validateConfig(cfg); err == nil {
+		t.Errorf("Expected error for select_process without select_process_port")
+	}
+}
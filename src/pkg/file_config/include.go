@@ -0,0 +1,166 @@
+// Resolves `include:` locations from files shipped next to the main config
+
+package file_config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type locationsFile struct {
+	Locations []LocationConfig `validate:"omitempty,dive" json:"locations"`
+}
+
+// ReadLocationsFile reads an included file, which holds a plain YAML list of
+// locations in the same format as a vhost's `locations`.
+func ReadLocationsFile(path string) ([]LocationConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var locations []LocationConfig
+	if err := yaml.Unmarshal(data, &locations); err != nil {
+		return nil, err
+	}
+
+	if err := validateStruct(&locationsFile{Locations: locations}); err != nil {
+		return nil, fmt.Errorf("config validation failed: %v", err)
+	}
+
+	return locations, nil
+}
+
+// ListIncludes returns the include paths directly referenced by the main
+// config or the locations file at path, resolved relative to path's directory.
+// Includes resolving outside of rootDir, path's directory when empty, are
+// rejected.
+func ListIncludes(path string, rootDir string) ([]string, error) {
+	if rootDir == "" {
+		rootDir = filepath.Dir(path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+
+	var locations []LocationConfig
+	if len(node.Content) > 0 && node.Content[0].Kind == yaml.SequenceNode {
+		if err := node.Decode(&locations); err != nil {
+			return nil, err
+		}
+	} else {
+		var config Config
+		if err := node.Decode(&config); err != nil {
+			return nil, err
+		}
+		for _, vhost := range config.Vhosts {
+			locations = append(locations, vhost.Locations...)
+		}
+	}
+
+	includes := make([]string, 0)
+	for _, location := range locations {
+		if location.Include == "" {
+			continue
+		}
+		includePath, err := resolveIncludePath(rootDir, path, location.Include)
+		if err != nil {
+			return nil, err
+		}
+		includes = append(includes, includePath)
+	}
+
+	return includes, nil
+}
+
+// ResolveLocationIncludes replaces every `include:` location of every vhost
+// with the locations read from the included file. Includes resolve relative to
+// the including file and may be nested.
+func ResolveLocationIncludes(configPath string, config *Config) error {
+	rootDir := filepath.Dir(configPath)
+
+	for i := range config.Vhosts {
+		locations, err := expandLocationIncludes(rootDir, config.Vhosts[i].Locations, []string{filepath.Clean(configPath)})
+		if err != nil {
+			return fmt.Errorf("vhost %s: %w", config.Vhosts[i].ServerName, err)
+		}
+		config.Vhosts[i].Locations = locations
+	}
+
+	return nil
+}
+
+func expandLocationIncludes(rootDir string, locations []LocationConfig, chain []string) ([]LocationConfig, error) {
+	expanded := make([]LocationConfig, 0, len(locations))
+
+	for _, location := range locations {
+		if location.Include == "" {
+			expanded = append(expanded, location)
+			continue
+		}
+
+		includingFile := chain[len(chain)-1]
+		includePath, err := resolveIncludePath(rootDir, includingFile, location.Include)
+		if err != nil {
+			return nil, fmt.Errorf("%w (include chain: %s)", err, formatIncludeChain(rootDir, chain))
+		}
+
+		includeChain := append(append([]string{}, chain...), includePath)
+		for _, seen := range chain {
+			if seen == includePath {
+				return nil, fmt.Errorf("include cycle detected: %s", formatIncludeChain(rootDir, includeChain))
+			}
+		}
+
+		included, err := ReadLocationsFile(includePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read include %s: %w (include chain: %s)", location.Include, err, formatIncludeChain(rootDir, includeChain))
+		}
+
+		included, err = expandLocationIncludes(rootDir, included, includeChain)
+		if err != nil {
+			return nil, err
+		}
+
+		expanded = append(expanded, included...)
+	}
+
+	return expanded, nil
+}
+
+// resolveIncludePath resolves include relative to the including file. The
+// included files come from the app image, so they have to stay within
+// rootDir, the directory of the main config.
+func resolveIncludePath(rootDir string, includingFile string, include string) (string, error) {
+	if filepath.IsAbs(include) {
+		return "", fmt.Errorf("include %s must be relative to the including file", include)
+	}
+	includePath := filepath.Join(filepath.Dir(includingFile), include)
+	relPath, err := filepath.Rel(rootDir, includePath)
+	if err != nil || !filepath.IsLocal(relPath) {
+		return "", fmt.Errorf("include %s resolves outside of the config directory", include)
+	}
+	return includePath, nil
+}
+
+func formatIncludeChain(rootDir string, chain []string) string {
+	names := make([]string, 0, len(chain))
+	for _, p := range chain {
+		if rel, err := filepath.Rel(rootDir, p); err == nil {
+			p = rel
+		}
+		names = append(names, p)
+	}
+	return strings.Join(names, " -> ")
+}
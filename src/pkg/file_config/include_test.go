@@ -0,0 +1,187 @@
+package file_config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create directory for %s: %v", path, err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+func TestResolveLocationIncludes(t *testing.T) {
+	t.Run("NestedIncludes", func(t *testing.T) {
+		tempDir := t.TempDir()
+		configPath := filepath.Join(tempDir, "nginx.yaml")
+
+		writeTestFile(t, configPath, `
+vhosts:
+  - server_name: api.example.com
+    locations:
+      - uri: /
+        body: return 200;
+      - include: .dokku/locations.yaml
+`)
+		writeTestFile(t, filepath.Join(tempDir, ".dokku", "locations.yaml"), `
+- uri: /api/
+  body: return 201;
+- include: nested/more.yaml
+`)
+		writeTestFile(t, filepath.Join(tempDir, ".dokku", "nested", "more.yaml"), `
+- uri: /fallback/
+  body: return 404;
+`)
+
+		cfg, _, err := ReadConfig(configPath)
+		if err != nil {
+			t.Fatalf("Expected no error reading config, got: %v", err)
+		}
+
+		if err := ResolveLocationIncludes(configPath, cfg); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		locations := cfg.Vhosts[0].Locations
+		if len(locations) != 3 {
+			t.Fatalf("Expected 3 locations, got: %d", len(locations))
+		}
+		if locations[1].Uri != "/api/" || locations[2].Uri != "/fallback/" {
+			t.Errorf("Unexpected locations order: %+v", locations)
+		}
+	})
+
+	t.Run("IncludeCycle", func(t *testing.T) {
+		tempDir := t.TempDir()
+		configPath := filepath.Join(tempDir, "nginx.yaml")
+
+		writeTestFile(t, configPath, `
+vhosts:
+  - server_name: api.example.com
+    locations:
+      - include: a.yaml
+`)
+		writeTestFile(t, filepath.Join(tempDir, "a.yaml"), `
+- include: b.yaml
+`)
+		writeTestFile(t, filepath.Join(tempDir, "b.yaml"), `
+- include: a.yaml
+`)
+
+		cfg, _, err := ReadConfig(configPath)
+		if err != nil {
+			t.Fatalf("Expected no error reading config, got: %v", err)
+		}
+
+		err = ResolveLocationIncludes(configPath, cfg)
+		if err == nil {
+			t.Fatalf("Expected include cycle error")
+		}
+		expected := "include cycle detected: nginx.yaml -> a.yaml -> b.yaml -> a.yaml"
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error to contain %q, got: %v", expected, err)
+		}
+	})
+
+	t.Run("EscapingInclude", func(t *testing.T) {
+		tempDir := t.TempDir()
+		configPath := filepath.Join(tempDir, "app", "nginx.yaml")
+
+		writeTestFile(t, configPath, `
+vhosts:
+  - server_name: api.example.com
+    locations:
+      - include: .dokku/locations.yaml
+`)
+		writeTestFile(t, filepath.Join(tempDir, "app", ".dokku", "locations.yaml"), `
+- include: ../../secret.yaml
+`)
+		writeTestFile(t, filepath.Join(tempDir, "secret.yaml"), `
+- uri: /secret/
+  body: return 200;
+`)
+
+		cfg, _, err := ReadConfig(configPath)
+		if err != nil {
+			t.Fatalf("Expected no error reading config, got: %v", err)
+		}
+
+		err = ResolveLocationIncludes(configPath, cfg)
+		if err == nil || !strings.Contains(err.Error(), "include ../../secret.yaml resolves outside of the config directory") {
+			t.Errorf("Expected the include escaping the config directory to be rejected, got: %v", err)
+		}
+	})
+
+	t.Run("MissingInclude", func(t *testing.T) {
+		tempDir := t.TempDir()
+		configPath := filepath.Join(tempDir, "nginx.yaml")
+
+		writeTestFile(t, configPath, `
+vhosts:
+  - server_name: api.example.com
+    locations:
+      - include: a.yaml
+`)
+		writeTestFile(t, filepath.Join(tempDir, "a.yaml"), `
+- include: missing.yaml
+`)
+
+		cfg, _, err := ReadConfig(configPath)
+		if err != nil {
+			t.Fatalf("Expected no error reading config, got: %v", err)
+		}
+
+		err = ResolveLocationIncludes(configPath, cfg)
+		if err == nil {
+			t.Fatalf("Expected missing include error")
+		}
+		expected := "include chain: nginx.yaml -> a.yaml -> missing.yaml"
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error to contain %q, got: %v", expected, err)
+		}
+	})
+}
+
+func TestListIncludes(t *testing.T) {
+	tempDir := t.TempDir()
+	configPath := filepath.Join(tempDir, "app", "nginx.yaml")
+	locationsPath := filepath.Join(tempDir, "app", ".dokku", "locations.yaml")
+
+	writeTestFile(t, configPath, `
+vhosts:
+  - server_name: api.example.com
+    locations:
+      - include: .dokku/locations.yaml
+`)
+	writeTestFile(t, locationsPath, `
+- include: ../shared/locations.yaml
+`)
+
+	includes, err := ListIncludes(configPath, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(includes) != 1 || includes[0] != locationsPath {
+		t.Errorf("Expected [%s], got: %v", locationsPath, includes)
+	}
+
+	includes, err = ListIncludes(locationsPath, filepath.Dir(configPath))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	expected := filepath.Join(tempDir, "app", "shared", "locations.yaml")
+	if len(includes) != 1 || includes[0] != expected {
+		t.Errorf("Expected [%s], got: %v", expected, includes)
+	}
+
+	if _, err := ListIncludes(locationsPath, ""); err == nil || !strings.Contains(err.Error(), "outside of the config directory") {
+		t.Errorf("Expected an include above the root to be rejected, got: %v", err)
+	}
+}
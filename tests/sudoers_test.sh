@@ -0,0 +1,62 @@
+#!/usr/bin/env bash
+# Checks that the nginx commands the builder runs with sudo are allowed by the
+# sudoers file written at install.
+set -eo pipefail
+
+PLUGIN_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")/.." && pwd)"
+TEST_DIR="$(mktemp -d)"
+trap 'rm -rf "$TEST_DIR"' EXIT
+
+# stand-ins for the dokku core functions internal-functions sources
+mkdir -p "$TEST_DIR/core/common" "$TEST_DIR/bin"
+cat >"$TEST_DIR/core/common/functions" <<'STUB'
+dokku_log_fail() {
+  echo "$*" >&2
+  exit 1
+}
+STUB
+touch "$TEST_DIR/core/common/property-functions"
+printf '#!/bin/sh\n' >"$TEST_DIR/bin/nginx"
+chmod +x "$TEST_DIR/bin/nginx"
+
+export PLUGIN_CORE_AVAILABLE_PATH="$TEST_DIR/core"
+export PATH="$TEST_DIR/bin:$PATH"
+source "$PLUGIN_DIR/internal-functions"
+
+failures=0
+
+assert_permitted() {
+  declare desc="fails the test when the sudo command is not among the sudoers entries"
+  declare COMMAND="$1" ENTRIES="$2"
+  local entry
+
+  if [[ "$COMMAND" != "sudo "* ]]; then
+    echo "FAIL: $COMMAND does not run through sudo"
+    failures=$((failures + 1))
+    return
+  fi
+
+  while read -r entry; do
+    if [[ "$entry" == "${COMMAND#sudo }" ]]; then
+      echo "ok: $COMMAND"
+      return
+    fi
+  done < <(tr ',' '\n' <<<"$ENTRIES")
+
+  echo "FAIL: $COMMAND is not permitted by the sudoers entries: $ENTRIES"
+  failures=$((failures + 1))
+}
+
+entries="$(fn-nginx-custom-sudoers-nginx-commands "$(fn-nginx-custom-nginx-location)")"
+assert_permitted "$(fn-nginx-custom-nginx-test-command)" "$entries"
+assert_permitted "$(fn-nginx-custom-nginx-reload-command)" "$entries"
+
+# every sudoers line written at install has to carry the nginx commands
+sudoers_lines="$(grep -c 'echo "%dokku ALL=(ALL) NOPASSWD:' "$PLUGIN_DIR/install")"
+nginx_lines="$(grep -c 'fn-nginx-custom-sudoers-nginx-commands "$NGINX_BIN")" >"$NGINX_SUDOERS_FILE"' "$PLUGIN_DIR/install")"
+if [[ "$sudoers_lines" -ne "$nginx_lines" ]]; then
+  echo "FAIL: only $nginx_lines of the $sudoers_lines sudoers lines in install permit the nginx commands"
+  failures=$((failures + 1))
+fi
+
+[[ "$failures" -eq 0 ]]